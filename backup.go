@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// backupEntry is a key in the JSON format used by `consul kv export` and `consul kv import`
+type backupEntry struct {
+	Key   string `json:"key"`
+	Flags uint64 `json:"flags"`
+	Value string `json:"value"`
+}
+
+// sortedPairs returns the pairs in pairs ordered by key
+func sortedPairs(pairs map[string]*api.KVPair) api.KVPairs {
+	sorted := make(api.KVPairs, 0, len(pairs))
+	for _, pair := range pairs {
+		sorted = append(sorted, pair)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
+
+// checkBackupPrefix makes sure BACKUP_PREFIX and CONSUL_KEY_PREFIX don't overlap,
+// otherwise syncing would delete the backup or back up the backup
+func checkBackupPrefix() error {
+	backupPrefix := viper.GetString("BACKUP_PREFIX")
+	prefix := viper.GetString("CONSUL_KEY_PREFIX")
+	if backupPrefix == "" {
+		return nil
+	}
+	if strings.HasPrefix(backupPrefix+"/", prefix+"/") || strings.HasPrefix(prefix+"/", backupPrefix+"/") {
+		return fmt.Errorf("D2C_BACKUP_PREFIX %s must not overlap D2C_CONSUL_KEY_PREFIX %s", backupPrefix, prefix)
+	}
+	return nil
+}
+
+// writeBackup saves consulPairs to BACKUP_FILE, in the format of `consul kv export`,
+// and under BACKUP_PREFIX in Consul. Either, both or neither may be set.
+func writeBackup(consulPairs map[string]*api.KVPair, consulClient *api.Client) error {
+	pairs := sortedPairs(consulPairs)
+
+	if backupFile := viper.GetString("BACKUP_FILE"); backupFile != "" {
+		entries := make([]backupEntry, 0, len(pairs))
+		for _, pair := range pairs {
+			entries = append(entries, backupEntry{Key: pair.Key, Flags: pair.Flags, Value: base64.StdEncoding.EncodeToString(pair.Value)})
+		}
+		out, err := json.MarshalIndent(entries, "", "\t")
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(backupFile, out)
+		if err != nil {
+			return err
+		}
+		if viper.GetBool("VERBOSE") {
+			log.Printf("Backed up %d keys to %s", len(pairs), backupFile)
+		}
+	}
+
+	if backupPrefix := viper.GetString("BACKUP_PREFIX"); backupPrefix != "" {
+		err := checkBackupPrefix()
+		if err != nil {
+			return err
+		}
+
+		// Replace the previous backup. The prefix key records what was backed up
+		// and is written last, in the last batch, so a backup that fails partway
+		// through has no prefix key and can't be restored.
+		ops := api.TxnOps{
+			{KV: &api.KVTxnOp{Verb: api.KVDeleteTree, Key: backupPrefix + "/"}},
+		}
+		for _, pair := range pairs {
+			ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: backupPrefix + "/keys/" + pair.Key, Value: pair.Value, Flags: pair.Flags}})
+		}
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: backupPrefix + "/prefix", Value: []byte(viper.GetString("CONSUL_KEY_PREFIX"))}})
+		err = applyTxnOps(ops, consulClient)
+		if err != nil {
+			return err
+		}
+		if viper.GetBool("VERBOSE") {
+			log.Printf("Backed up %d keys under %s", len(pairs), backupPrefix)
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so path never holds a partly written backup
+func writeFileAtomic(path string, data []byte) error {
+	// The values may well be secrets, so keep the backup private. TempFile
+	// creates the file readable only by its owner.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// readBackup loads the backup from BACKUP_FILE or, when that isn't set, from under BACKUP_PREFIX
+func readBackup(consulClient *api.Client) (api.KVPairs, error) {
+	var backup api.KVPairs
+	prefix := viper.GetString("CONSUL_KEY_PREFIX")
+
+	switch {
+	case viper.GetString("BACKUP_FILE") != "":
+		backupFile := viper.GetString("BACKUP_FILE")
+		in, err := ioutil.ReadFile(backupFile)
+		if err != nil {
+			return nil, err
+		}
+		var entries []backupEntry
+		err = json.Unmarshal(in, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading backup %s: %v", backupFile, err)
+		}
+		for _, entry := range entries {
+			value, err := base64.StdEncoding.DecodeString(entry.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading backup %s: key %s: %v", backupFile, entry.Key, err)
+			}
+			backup = append(backup, &api.KVPair{Key: entry.Key, Flags: entry.Flags, Value: value})
+		}
+
+	case viper.GetString("BACKUP_PREFIX") != "":
+		err := checkBackupPrefix()
+		if err != nil {
+			return nil, err
+		}
+		backupPrefix := viper.GetString("BACKUP_PREFIX")
+		var pairs api.KVPairs
+		err = retry("Listing "+backupPrefix, func() error {
+			var err error
+			pairs, _, err = consulClient.KV().List(backupPrefix+"/", nil)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, pair := range pairs {
+			switch {
+			case pair.Key == backupPrefix+"/prefix":
+				if string(pair.Value) != prefix {
+					return nil, fmt.Errorf("Backup under %s is of %s, not %s", backupPrefix, pair.Value, prefix)
+				}
+				found = true
+			case strings.HasPrefix(pair.Key, backupPrefix+"/keys/"):
+				backup = append(backup, &api.KVPair{Key: strings.TrimPrefix(pair.Key, backupPrefix+"/keys/"), Flags: pair.Flags, Value: pair.Value})
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No backup found under %s", backupPrefix)
+		}
+
+	default:
+		return nil, fmt.Errorf("Set D2C_BACKUP_FILE or D2C_BACKUP_PREFIX to restore")
+	}
+
+	for _, pair := range backup {
+		if !strings.HasPrefix(pair.Key, prefix+"/") {
+			return nil, fmt.Errorf("Backup key %s is not under %s", pair.Key, prefix)
+		}
+	}
+	return backup, nil
+}
+
+// newRestorePlan compares a backup to the Consul data and returns a plan that
+// puts every key back, flags included, and deletes keys the backup doesn't have
+func newRestorePlan(backup api.KVPairs, consulPairs map[string]*api.KVPair) *plan {
+	p := &plan{Prefix: viper.GetString("CONSUL_KEY_PREFIX"), Entries: []planEntry{}, consulPairs: consulPairs}
+
+	restored := make(map[string]bool)
+	for _, b := range backup {
+		restored[b.Key] = true
+		e := planEntry{Key: b.Key, New: newPlanValue(b.Value), value: b.Value, flags: b.Flags}
+		c, ok := consulPairs[b.Key]
+		switch {
+		case !ok:
+			e.Action = actionAdd
+		case bytes.Equal(b.Value, c.Value) && b.Flags == c.Flags:
+			e.Action = actionUnchanged
+			e.Old = e.New
+		default:
+			e.Action = actionUpdate
+			e.Old = newPlanValue(c.Value)
+			e.index = c.ModifyIndex
+		}
+		p.Entries = append(p.Entries, e)
+	}
+
+	for key, c := range consulPairs {
+		if !restored[key] {
+			p.Entries = append(p.Entries, planEntry{Key: key, Action: actionDelete, Old: newPlanValue(c.Value), index: c.ModifyIndex})
+		}
+	}
+
+	sort.Slice(p.Entries, func(i, j int) bool { return p.Entries[i].Key < p.Entries[j].Key })
+	p.markRedacted()
+	return p
+}
+
+// restoreBackup puts CONSUL_KEY_PREFIX back the way it was when the backup was taken.
+// Protected keys and the lock key are left alone, as they are when syncing.
+func restoreBackup(consulClient *api.Client) error {
+	backup, err := readBackup(consulClient)
+	if err != nil {
+		return err
+	}
+
+	_, consulPairs, err := loadKeyValuesFromConsul(consulClient)
+	if err != nil {
+		return err
+	}
+
+	p := newRestorePlan(backup, consulPairs)
+	err = p.skipUnmanaged()
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool("DRYRUN") || viper.GetBool("VERBOSE") {
+		err = writePlan(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.checkDeleteLimits()
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool("DRYRUN") {
+		return nil
+	}
+
+	err = applyTxnOps(p.txnOps(), consulClient)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %d keys under %s", len(backup), p.Prefix)
+	return nil
+}
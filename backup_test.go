@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/hashicorp/consul/api"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cases := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"file", map[string]string{"D2C_BACKUP_FILE": filepath.Join(dir, "backup.json")}},
+		{"prefix", map[string]string{"D2C_BACKUP_PREFIX": "backups/dir2consul"}},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range tc.env {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			original := map[string]string{
+				"dir2consul/same":    "same",
+				"dir2consul/changed": "hand edited",
+				"dir2consul/removed": "hand made",
+			}
+			fake, client := newFakeConsul(t, original)
+
+			fileKeyValues := kv.NewList()
+			_, _, _ = fileKeyValues.Set("dir2consul/same", []byte("same"))
+			_, _, _ = fileKeyValues.Set("dir2consul/changed", []byte("from file"))
+			_, _, _ = fileKeyValues.Set("dir2consul/added", []byte("from file"))
+
+			_, err := syncConsul(fileKeyValues, nil, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fake.values()["dir2consul/changed"] != "from file" {
+				t.Fatal("sync did not apply")
+			}
+
+			err = restoreBackup(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := fake.values()
+			for k, v := range original {
+				if actual[k] != v {
+					t.Errorf("key %s: expected %q, got %q", k, v, actual[k])
+				}
+			}
+			if _, ok := actual["dir2consul/added"]; ok {
+				t.Error("restore should delete keys added by the sync")
+			}
+		})
+	}
+}
+
+func TestBackupFileFormat(t *testing.T) {
+	backupFile, err := ioutil.TempFile("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(backupFile.Name()) }()
+	_ = backupFile.Close()
+
+	os.Clearenv()
+	err = os.Setenv("D2C_BACKUP_FILE", backupFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	_, client := newFakeConsul(t, nil)
+	_, consulPairs, err := loadKeyValuesFromConsul(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consulPairs["dir2consul/key"] = &api.KVPair{Key: "dir2consul/key", Flags: 42, Value: []byte("value")}
+	err = writeBackup(consulPairs, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := ioutil.ReadFile(backupFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]interface{}
+	err = json.Unmarshal(in, &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"key": "dir2consul/key", "flags": float64(42), "value": "dmFsdWU="}
+	if len(entries) != 1 || fmt.Sprint(entries[0]) != fmt.Sprint(expect) {
+		t.Errorf("expected %v, got %s", expect, in)
+	}
+}
+
+func TestBackupBesidePrefix(t *testing.T) {
+	os.Clearenv()
+	err := os.Setenv("D2C_BACKUP_PREFIX", "dir2consul-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, map[string]string{"dir2consul/key": "old"})
+
+	// The second sync must neither plan to delete the first one's backup nor conflict with it
+	for run, value := range []string{"new", "newer"} {
+		fileKeyValues := kv.NewList()
+		_, _, _ = fileKeyValues.Set("dir2consul/key", []byte(value))
+		_, err = syncConsul(fileKeyValues, nil, client)
+		if err != nil {
+			t.Fatalf("sync %d: %v", run+1, err)
+		}
+	}
+	expect := map[string]string{
+		"dir2consul/key":                        "newer",
+		"dir2consul-backup/prefix":              "dir2consul",
+		"dir2consul-backup/keys/dir2consul/key": "new",
+	}
+	actual := fake.values()
+	if len(actual) != len(expect) {
+		t.Errorf("expected %v, got %v", expect, actual)
+	}
+	for k, v := range expect {
+		if actual[k] != v {
+			t.Errorf("key %s: expected %q, got %q", k, v, actual[k])
+		}
+	}
+}
+
+func TestBackupPartial(t *testing.T) {
+	os.Clearenv()
+	for k, v := range map[string]string{"D2C_BACKUP_PREFIX": "backups/dir2consul", "D2C_RETRY_ATTEMPTS": "1"} {
+		err := os.Setenv(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupEnvironment()
+
+	// Enough keys for several transactions, and an earlier complete backup
+	original := map[string]string{"backups/dir2consul/prefix": "dir2consul", "backups/dir2consul/keys/dir2consul/old": "old"}
+	for i := 0; i < maxTxnOps*2; i++ {
+		original[fmt.Sprintf("dir2consul/key%03d", i)] = "v"
+	}
+	fake, client := newFakeConsul(t, original)
+	fake.failTxn = func(n int) string {
+		if n > 1 {
+			return "No cluster leader"
+		}
+		return ""
+	}
+
+	_, consulPairs, err := loadKeyValuesFromConsul(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeBackup(consulPairs, client)
+	if err == nil {
+		t.Fatal("expected the backup to fail")
+	}
+	if fake.txns < 2 {
+		t.Fatalf("expected the backup to need several transactions, got %d", fake.txns)
+	}
+
+	// The partial backup has no prefix key, so it can't be restored
+	_, err = readBackup(client)
+	if err == nil || !strings.Contains(err.Error(), "No backup found") {
+		t.Errorf("expected the partial backup to be rejected, got %v", err)
+	}
+}
+
+func TestCheckBackupPrefix(t *testing.T) {
+	cases := []struct {
+		backupPrefix string
+		expectErr    bool
+	}{
+		{"", false},
+		{"backups", false},
+		{"dir2consul-backup", false},
+		{"dir2consul", true},
+		{"dir2consul/backup", true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.backupPrefix), func(t *testing.T) {
+			os.Clearenv()
+			err := os.Setenv("D2C_BACKUP_PREFIX", tc.backupPrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			err = checkBackupPrefix()
+			if tc.expectErr != (err != nil) {
+				t.Errorf("expected error %t, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/magiconair/properties"
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// configValues is the keys and values loaded from configuration files, with
+// nested keys joined by "/". Unlike viper, it keeps the case of keys unless
+// LOWERCASE_KEYS is set.
+type configValues struct {
+	values map[string]interface{}
+	// source is the nested values that flatten to values, with scalars kept
+	// as they were written
+	source map[string]interface{}
+	// tree is the parsed document, with maps keyed by strings
+	tree map[string]interface{}
+	// layers are the trees of the files merged, in order
+	layers []configLayer
+}
+
+// configLayer is the parsed document of one file
+type configLayer struct {
+	file string
+	tree map[string]interface{}
+}
+
+func newConfigValues() *configValues {
+	return &configValues{values: make(map[string]interface{}), source: make(map[string]interface{}), tree: make(map[string]interface{})}
+}
+
+// AllKeys returns the keys, sorted
+func (c *configValues) AllKeys() []string {
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetString returns the value of key as a string, the way viper does
+func (c *configValues) GetString(key string) string {
+	return cast.ToString(c.values[key])
+}
+
+// set stores value under key
+func (c *configValues) set(key string, value interface{}) {
+	c.values[key] = value
+}
+
+// setSource stores the nested values m, lowercasing their keys when
+// LOWERCASE_KEYS is set, and flattens them into keys
+func (c *configValues) setSource(m map[string]interface{}) {
+	c.source = documentValue(m, viper.GetBool("LOWERCASE_KEYS")).(map[string]interface{})
+	c.values = make(map[string]interface{})
+	c.flatten("", c.source)
+}
+
+// merge copies other over c. The nested values are merged and flattened
+// again, so a value that replaces a map, list or scalar leaves none of the
+// keys it replaced behind, just as in the merged tree.
+func (c *configValues) merge(other *configValues) {
+	mergeTree(c.source, other.source)
+	c.values = make(map[string]interface{})
+	c.flatten("", c.source)
+	mergeTree(c.tree, other.tree)
+}
+
+// mergeTree copies src over dst, merging the maps they both have
+func mergeTree(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcOK := value.(map[string]interface{})
+		dstMap, dstOK := dst[key].(map[string]interface{})
+		if srcOK && dstOK {
+			mergeTree(dstMap, srcMap)
+			continue
+		}
+		if srcOK {
+			// Copy maps so merging more files doesn't change src
+			copied := make(map[string]interface{}, len(srcMap))
+			mergeTree(copied, srcMap)
+			value = copied
+		}
+		dst[key] = value
+	}
+}
+
+// setTree stores the parsed document m, lowercasing its keys when
+// LOWERCASE_KEYS is set
+func (c *configValues) setTree(m map[string]interface{}) {
+	c.tree = documentValue(m, viper.GetBool("LOWERCASE_KEYS")).(map[string]interface{})
+}
+
+// documentValue returns value with its maps keyed by strings, lowercased if lowercase
+func documentValue(value interface{}, lowercase bool) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		return documentValue(cast.ToStringMap(v), lowercase)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if lowercase {
+				k = strings.ToLower(k)
+			}
+			m[k] = documentValue(e, lowercase)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			l = append(l, documentValue(e, lowercase))
+		}
+		return l
+	case []map[string]interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			l = append(l, documentValue(e, lowercase))
+		}
+		return l
+	}
+	return value
+}
+
+// flatten sets the leaves of the nested map m, with their keys below prefix.
+// How lists, empty maps, nulls and scalars are written depends on VALUE_ENCODING.
+func (c *configValues) flatten(prefix string, m map[string]interface{}) {
+	encoding := viper.GetString("VALUE_ENCODING")
+	for key, value := range m {
+		if prefix != "" {
+			key = prefix + "/" + key
+		}
+		c.flattenValue(key, value, encoding)
+	}
+}
+
+// flattenValue sets value under key, or its leaves below key
+func (c *configValues) flattenValue(key string, value interface{}, encoding string) {
+	switch nested := value.(type) {
+	case map[interface{}]interface{}:
+		c.flattenValue(key, cast.ToStringMap(nested), encoding)
+	case map[string]interface{}:
+		if len(nested) == 0 && encoding == "json" {
+			c.set(key, "{}")
+			return
+		}
+		for name, v := range nested {
+			c.flattenValue(key+"/"+name, v, encoding)
+		}
+	case []map[string]interface{}:
+		// Tables in lists, from TOML and HCL
+		l := make([]interface{}, 0, len(nested))
+		for _, e := range nested {
+			l = append(l, e)
+		}
+		c.flattenValue(key, l, encoding)
+	case []interface{}:
+		switch encoding {
+		case "json":
+			c.set(key, encodeJSON(nested))
+		case "indexed":
+			for i, v := range nested {
+				c.flattenValue(key+"/"+strconv.Itoa(i), v, encoding)
+			}
+		default:
+			// viper's strings for lists are empty
+			c.set(key, value)
+		}
+	case nil:
+		// viper drops nulls
+		if encoding != "string" {
+			c.set(key, "null")
+		}
+	default:
+		if encoding == "string" {
+			c.set(key, value)
+			return
+		}
+		c.set(key, literalString(value))
+	}
+}
+
+// literal is a YAML scalar, with the text it was written as
+type literal struct {
+	text  string
+	value interface{}
+}
+
+// MarshalJSON writes numbers as they were written when that is valid JSON
+func (l literal) MarshalJSON() ([]byte, error) {
+	switch l.value.(type) {
+	case int, int64, uint64, float64:
+		if json.Valid([]byte(l.text)) {
+			return []byte(l.text), nil
+		}
+	}
+	return json.Marshal(documentValue(l.value, false))
+}
+
+// yamlLiteral decodes YAML as decoding into interface{} does, except that
+// scalars are literals
+type yamlLiteral struct {
+	value interface{}
+}
+
+func (y *yamlLiteral) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	err := unmarshal(&value)
+	if err != nil {
+		return err
+	}
+	switch value.(type) {
+	case map[interface{}]interface{}:
+		var m map[interface{}]yamlLiteral
+		err = unmarshal(&m)
+		if err != nil {
+			return err
+		}
+		nested := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			nested[cast.ToString(k)] = v.value
+		}
+		y.value = nested
+	case []interface{}:
+		var l []yamlLiteral
+		err = unmarshal(&l)
+		if err != nil {
+			return err
+		}
+		nested := make([]interface{}, 0, len(l))
+		for _, v := range l {
+			nested = append(nested, v.value)
+		}
+		y.value = nested
+	case nil:
+	default:
+		// Decoding a scalar into a string gives the text it was written as
+		var text string
+		err = unmarshal(&text)
+		if err != nil {
+			return err
+		}
+		y.value = literal{text: text, value: value}
+	}
+	return nil
+}
+
+// literalString returns a scalar as it was written where the format keeps
+// that, and in a standard form otherwise
+func literalString(value interface{}) string {
+	switch v := value.(type) {
+	case literal:
+		return v.text
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return cast.ToString(value)
+}
+
+// encodeJSON returns value as compact JSON, without escaping HTML characters
+func encodeJSON(value interface{}) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(documentValue(value, false))
+	if err != nil {
+		// Only values from the parsers get here, and they all encode
+		return cast.ToString(value)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// decode parses content as filetype into c. It reads each format the
+// way viper does, except that the case of keys is kept.
+func (c *configValues) decode(content []byte, filetype string) error {
+	m := make(map[string]interface{})
+	switch filetype {
+	case "yaml", "yml":
+		err := yaml.Unmarshal(content, &m)
+		if err != nil {
+			return err
+		}
+		c.setTree(m)
+		if viper.GetString("VALUE_ENCODING") != "string" {
+			var literals map[string]yamlLiteral
+			err = yaml.Unmarshal(content, &literals)
+			if err != nil {
+				return err
+			}
+			m = make(map[string]interface{}, len(literals))
+			for k, v := range literals {
+				m[k] = v.value
+			}
+		}
+	case "json":
+		err := json.Unmarshal(content, &m)
+		if err != nil {
+			return err
+		}
+		c.setTree(m)
+		if viper.GetString("VALUE_ENCODING") != "string" {
+			// Numbers keep the text they were written as
+			m = make(map[string]interface{})
+			decoder := json.NewDecoder(bytes.NewReader(content))
+			decoder.UseNumber()
+			err = decoder.Decode(&m)
+			if err != nil {
+				return err
+			}
+		}
+	case "hcl":
+		obj, err := hcl.Parse(string(content))
+		if err != nil {
+			return err
+		}
+		err = hcl.DecodeObject(&m, obj)
+		if err != nil {
+			return err
+		}
+	case "toml":
+		tree, err := toml.LoadReader(bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		m = tree.ToMap()
+	case "properties", "props", "prop":
+		p, err := properties.Load(content, properties.UTF8)
+		if err != nil {
+			return err
+		}
+		// Dots in property names nest, as they do in viper
+		for _, key := range p.Keys() {
+			value, _ := p.Get(key)
+			setDotted(m, key, value)
+		}
+		c.setTree(m)
+	case "env":
+		pairs, err := parseDotenv(content)
+		if err != nil {
+			return err
+		}
+		// Names nest on dots like property names, and the last value set wins
+		for _, pair := range pairs {
+			setDotted(m, pair.name, pair.value)
+		}
+		c.setTree(m)
+	case "ini":
+		cfg := ini.Empty()
+		err := cfg.Append(content)
+		if err != nil {
+			return err
+		}
+		// Keys are named section.key, so they don't nest
+		flat := make(map[string]interface{})
+		for _, section := range cfg.Sections() {
+			if len(section.Keys()) == 0 {
+				continue
+			}
+			values := make(map[string]interface{})
+			for _, key := range section.Keys() {
+				flat[section.Name()+"."+key.Name()] = key.String()
+				values[key.Name()] = key.String()
+			}
+			m[section.Name()] = values
+		}
+		c.setTree(m)
+		c.setSource(flat)
+		return nil
+	default:
+		return viper.UnsupportedConfigError(filetype)
+	}
+	if filetype == "hcl" || filetype == "toml" {
+		c.setTree(m)
+	}
+	c.setSource(m)
+	return nil
+}
+
+// setDotted sets a value whose name nests on dots in tree
+func setDotted(tree map[string]interface{}, name string, value string) {
+	path := strings.Split(name, ".")
+	node := tree
+	for _, segment := range path[:len(path)-1] {
+		next, ok := node[segment].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			node[segment] = next
+		}
+		node = next
+	}
+	node[path[len(path)-1]] = value
+}
+
+// document encodes the merged files as a single value, as canonical JSON when
+// DOCUMENT_FORMAT is json, or else in filetype
+func (c *configValues) document(filetype string) ([]byte, error) {
+	return encodeDocument(c.tree, filetype)
+}
+
+// encodeDocument encodes tree as canonical JSON when DOCUMENT_FORMAT is json,
+// or else in filetype. HCL is written as JSON, which HCL reads.
+func encodeDocument(tree map[string]interface{}, filetype string) ([]byte, error) {
+	if viper.GetString("DOCUMENT_FORMAT") == "json" {
+		return []byte(encodeJSON(tree)), nil
+	}
+	switch filetype {
+	case "yaml", "yml":
+		return yaml.Marshal(tree)
+	case "toml":
+		t, err := toml.TreeFromMap(tree)
+		if err != nil {
+			return nil, err
+		}
+		s, err := t.ToTomlString()
+		return []byte(s), err
+	case "properties", "props", "prop":
+		p := properties.NewProperties()
+		err := setProperties(p, "", tree)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		_, err = p.Write(&buf, properties.UTF8)
+		return buf.Bytes(), err
+	case "env":
+		return encodeDotenv(tree), nil
+	case "ini":
+		cfg := ini.Empty()
+		for _, name := range sortedKeys(tree) {
+			section, ok := tree[name].(map[string]interface{})
+			if !ok {
+				section = map[string]interface{}{name: tree[name]}
+				name = ini.DefaultSection
+			}
+			for _, key := range sortedKeys(section) {
+				_, err := cfg.Section(name).NewKey(key, literalString(section[key]))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		var buf bytes.Buffer
+		_, err := cfg.WriteTo(&buf)
+		return buf.Bytes(), err
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(documentValue(tree, false))
+	return buf.Bytes(), err
+}
+
+// setProperties sets the leaves of tree in p, with nested names joined by dots
+func setProperties(p *properties.Properties, prefix string, tree map[string]interface{}) error {
+	for _, name := range sortedKeys(tree) {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		var err error
+		switch v := tree[name].(type) {
+		case map[string]interface{}:
+			err = setProperties(p, key, v)
+		case []interface{}:
+			_, _, err = p.Set(key, encodeJSON(v))
+		default:
+			_, _, err = p.Set(key, literalString(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m, sorted
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/code42/dir2consul/kv"
+)
+
+func TestKeyCase(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"app.yaml":       "featureFlags:\n  newCheckout: true\n",
+		"app.json":       `{"featureFlags": {"darkMode": false}}`,
+		"app.toml":       "[featureFlags]\nbetaSearch = true\n",
+		"app.hcl":        "featureFlags = {\n  fastPay = true\n}\n",
+		"app.properties": "featureFlags.oneClick=true\n",
+		"app.ini":        "[featureFlags]\nquickView = true\n",
+		"legacy":         "blob",
+		"default.yaml":   "Region: us\n",
+	})
+	cases := []struct {
+		lowercase string
+		expect    []string
+	}{
+		{
+			"false",
+			[]string{
+				"dir2consul/app/featureFlags/newCheckout : true",
+				"dir2consul/app/featureFlags/darkMode : false",
+				"dir2consul/app/featureFlags/betaSearch : true",
+				"dir2consul/app/featureFlags/oneClick : true",
+				"dir2consul/app/featureFlags.quickView : true",
+				"dir2consul/app/Region : us",
+				"dir2consul/legacy : blob",
+			},
+		},
+		{
+			"true",
+			[]string{
+				"dir2consul/app/featureflags/newcheckout : true",
+				"dir2consul/app/featureflags/darkmode : false",
+				"dir2consul/app/featureflags/betasearch : true",
+				"dir2consul/app/featureflags/oneclick : true",
+				"dir2consul/app/featureflags.quickview : true",
+				"dir2consul/app/region : us",
+				"dir2consul/legacy : blob",
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_lowercase_%s", i, tc.lowercase), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range map[string]string{"D2C_DIRECTORY": dir, "D2C_LOWERCASE_KEYS": tc.lowercase, "D2C_ON_COLLISION": "precedence"} {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			var rendered bytes.Buffer
+			err := runRender(&rendered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expect := range tc.expect {
+				if !strings.Contains(rendered.String(), expect+"\n") {
+					t.Errorf("expected %q in:\n%s", expect, rendered.String())
+				}
+			}
+		})
+	}
+}
+
+func TestValueEncoding(t *testing.T) {
+	// Each file has a list with a nested object, a float, and a list of tables where the format has them
+	dir := writeTree(t, map[string]string{
+		"app.yaml":       "list: [1.50, a, true, {k: v}]\nversion: 1.10\nnothing: ~\nservers:\n  - host: a\n    port: 80\n",
+		"app.json":       `{"list": [1.50, "a", true, {"k": "v"}], "version": 1.10, "nothing": null, "servers": [{"host": "a", "port": 80}]}`,
+		"app.toml":       "list = [1.5, 2.5]\nversion = 1.10\n[[servers]]\nhost = \"a\"\nport = 80\n",
+		"app.hcl":        "list = [1.5, 2.5]\nversion = 1.10\nservers {\n  host = \"a\"\n  port = 80\n}\n",
+		"app.properties": "list=[1.50, a]\nversion=1.10\n",
+		"app.ini":        "list=[1.50, a]\nversion=1.10\n",
+	})
+
+	cases := []struct {
+		encoding string
+		file     string
+		expect   map[string]string
+	}{
+		{"string", "yaml", map[string]string{"list": "", "version": "1.1", "servers": ""}},
+		{"json", "yaml", map[string]string{"list": `[1.50,"a",true,{"k":"v"}]`, "version": "1.10", "nothing": "null", "servers": `[{"host":"a","port":80}]`}},
+		{"json", "json", map[string]string{"list": `[1.50,"a",true,{"k":"v"}]`, "version": "1.10", "nothing": "null", "servers": `[{"host":"a","port":80}]`}},
+		{"json", "toml", map[string]string{"list": "[1.5,2.5]", "version": "1.1", "servers": `[{"host":"a","port":80}]`}},
+		{"json", "hcl", map[string]string{"list": "[1.5,2.5]", "version": "1.1", "servers": `[{"host":"a","port":80}]`}},
+		{"json", "properties", map[string]string{"list": "[1.50, a]", "version": "1.10"}},
+		{"json", "ini", map[string]string{"DEFAULT.list": "[1.50, a]", "DEFAULT.version": "1.10"}},
+		{"indexed", "yaml", map[string]string{"list/0": "1.50", "list/1": "a", "list/2": "true", "list/3/k": "v", "servers/0/host": "a", "servers/0/port": "80"}},
+		{"indexed", "json", map[string]string{"list/0": "1.50", "list/1": "a", "list/2": "true", "list/3/k": "v", "servers/0/host": "a", "servers/0/port": "80"}},
+		{"indexed", "toml", map[string]string{"list/0": "1.5", "list/1": "2.5", "servers/0/host": "a", "servers/0/port": "80"}},
+		{"indexed", "hcl", map[string]string{"list/0": "1.5", "list/1": "2.5", "servers/0/host": "a", "servers/0/port": "80"}},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s_%s", i, tc.encoding, tc.file), func(t *testing.T) {
+			os.Clearenv()
+			err := os.Setenv("D2C_VALUE_ENCODING", tc.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			v, err := loadFile(filepath.Join(dir, "app."+tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, expect := range tc.expect {
+				if actual := v.GetString(key); actual != expect {
+					t.Errorf("%s: expected %q, got %q", key, expect, actual)
+				}
+			}
+
+			// Lists decode back to what the file holds
+			var original []interface{}
+			switch tc.file {
+			case "yaml", "json":
+				original = []interface{}{1.5, "a", true, map[string]interface{}{"k": "v"}}
+			case "toml", "hcl":
+				original = []interface{}{1.5, 2.5}
+			}
+			if tc.encoding != "json" || original == nil {
+				return
+			}
+			var list []interface{}
+			err = json.Unmarshal([]byte(v.GetString("list")), &list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(list, original) {
+				t.Errorf("list: expected %v, got %v", original, list)
+			}
+		})
+	}
+
+	// A file's list replaces a default's list, rather than overriding its items one by one
+	layered := writeTree(t, map[string]string{
+		"default.yaml": "list: [a, b, c]\n",
+		"app.yaml":     "list: [x]\n",
+	})
+	os.Clearenv()
+	err := os.Setenv("D2C_VALUE_ENCODING", "indexed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+	v, err := mergeConfiguration([]string{filepath.Join(layered, "default.yaml"), filepath.Join(layered, "app.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := v.AllKeys(); !reflect.DeepEqual(keys, []string{"list/0"}) || v.GetString("list/0") != "x" {
+		t.Errorf("expected only list/0=x, got %v", v.values)
+	}
+
+	os.Clearenv()
+	err = os.Setenv("D2C_DIRECTORY", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_VALUE_ENCODING", "xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+	err = runValidate()
+	if err == nil || !strings.Contains(err.Error(), "D2C_VALUE_ENCODING") {
+		t.Errorf("expected an unknown encoding to fail, got %v", err)
+	}
+}
+
+func TestMergeReplaces(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"default.yaml": "db:\n  host: h\nport: 80\ntags: {a: b}\n",
+		"app.yaml":     "db: plain\nport:\n  http: 8080\ntags: {c: d}\n",
+	})
+	os.Clearenv()
+	setupEnvironment()
+
+	v, err := mergeConfiguration([]string{filepath.Join(dir, "default.yaml"), filepath.Join(dir, "app.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A scalar replaces a map, a map replaces a scalar, and maps merge
+	expect := []string{"db", "port/http", "tags/a", "tags/c"}
+	if !reflect.DeepEqual(v.AllKeys(), expect) {
+		t.Errorf("expected keys %v, got %v", expect, v.AllKeys())
+	}
+	if v.GetString("db") != "plain" || v.GetString("port/http") != "8080" {
+		t.Errorf("unexpected values %v", v.values)
+	}
+	tree := map[string]interface{}{"db": "plain", "port": map[string]interface{}{"http": 8080}, "tags": map[string]interface{}{"a": "b", "c": "d"}}
+	if !reflect.DeepEqual(v.tree, tree) {
+		t.Errorf("expected tree %v, got %v", tree, v.tree)
+	}
+}
+
+func TestDocument(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"default.yaml":          "region: us\nlimits:\n  cpu: 1\n",
+		"svc/app.yaml":          "name: billing\nlimits:\n  mem: 2\nhosts: [a, b]\n",
+		"svc/db.json":           `{"url": "<db>", "pool": {"size": 5}}`,
+		"svc/web.properties":    "listen.port=8080\n",
+		"svc/cache.toml":        "ttl = 30\n",
+		"svc/legacy.ini":        "[main]\nmode=fast\n",
+		"svc/plain.hcl":         "retries = 3\n",
+		"svc/vars.env":          "export MODE=\"a b\"\n",
+		"flattened/other.yaml":  "a: b\n",
+		"svc/sub/default.yaml":  "region: eu\n",
+		"svc/sub/override.yaml": "zone: 1\n",
+	})
+	merged := map[string]map[string]interface{}{
+		"svc/app":          {"region": "us", "limits": map[string]interface{}{"cpu": 1.0, "mem": 2.0}, "name": "billing", "hosts": []interface{}{"a", "b"}},
+		"svc/db":           {"region": "us", "limits": map[string]interface{}{"cpu": 1.0}, "url": "<db>", "pool": map[string]interface{}{"size": 5.0}},
+		"svc/web":          {"region": "us", "limits": map[string]interface{}{"cpu": 1.0}, "listen": map[string]interface{}{"port": "8080"}},
+		"svc/cache":        {"region": "us", "limits": map[string]interface{}{"cpu": 1.0}, "ttl": 30.0},
+		"svc/legacy":       {"region": "us", "limits": map[string]interface{}{"cpu": 1.0}, "main": map[string]interface{}{"mode": "fast"}},
+		"svc/plain":        {"region": "us", "limits": map[string]interface{}{"cpu": 1.0}, "retries": 3.0},
+		"svc/vars":         {"region": "us", "limits": map[string]interface{}{"cpu": 1.0}, "MODE": "a b"},
+		"svc/sub/override": {"region": "eu", "limits": map[string]interface{}{"cpu": 1.0}, "zone": 1.0},
+	}
+	sourceTypes := map[string]string{"svc/app": "yaml", "svc/db": "json", "svc/web": "properties", "svc/cache": "toml", "svc/legacy": "ini", "svc/plain": "json", "svc/vars": "env", "svc/sub/override": "yaml"}
+
+	for i, format := range []string{"json", "source"} {
+		t.Run(fmt.Sprintf("%d_%s", i, format), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range map[string]string{"D2C_DIRECTORY": dir, "D2C_DOCUMENT_REGEX": `^svc/`, "D2C_DOCUMENT_FORMAT": format} {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			kvs := kv.NewList()
+			report, err := loadKeyValuesFromDisk(kvs, regexp.MustCompile(`a^`), regexp.MustCompile(`a^`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = problemsError(report.problems)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, value, err := kvs.Get("dir2consul/flattened/other/a", nil); err != nil || string(value) != "b" {
+				t.Errorf("files not matching D2C_DOCUMENT_REGEX should be flattened, got %q, %v", value, err)
+			}
+
+			for key, expect := range merged {
+				_, value, err := kvs.Get("dir2consul/"+key, nil)
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				filetype := "json"
+				if format == "source" {
+					filetype = sourceTypes[key]
+				}
+
+				// The document reads back as the merged files, with numbers as floats and properties as strings
+				decoded := newConfigValues()
+				err = decoded.decode(value, filetype)
+				if err != nil {
+					t.Fatalf("%s: %v\n%s", key, err, value)
+				}
+				var actual, expected interface{}
+				normalized, err := json.Marshal(decoded.tree)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = json.Unmarshal(normalized, &actual)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected = map[string]interface{}(expect)
+				if filetype == "properties" || filetype == "ini" || filetype == "env" {
+					expected = stringLeaves(expect)
+				}
+				if filetype == "ini" {
+					// Values outside a section go in the default section
+					sections := stringLeaves(expect)
+					sections["DEFAULT"] = map[string]interface{}{"region": sections["region"]}
+					delete(sections, "region")
+					expected = sections
+				}
+				if !reflect.DeepEqual(actual, expected) {
+					t.Errorf("%s: expected %v, got %v\n%s", key, expected, actual, value)
+				}
+			}
+		})
+	}
+}
+
+// stringLeaves returns m with its leaves as strings, as formats without types load them
+func stringLeaves(m map[string]interface{}) map[string]interface{} {
+	s := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok {
+			s[k] = stringLeaves(nested)
+			continue
+		}
+		s[k] = fmt.Sprint(v)
+	}
+	return s
+}
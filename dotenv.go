@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// dotenvPair is a name and value read from a .env file
+type dotenvPair struct {
+	name  string
+	value string
+}
+
+// dotenvName matches the names a .env file can set. Dots are allowed so
+// names can nest, as they do in properties files.
+var dotenvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// parseDotenv reads KEY=VALUE lines, in order. Blank lines and lines starting
+// with "#" are skipped, and a leading "export" is ignored. Unquoted values end
+// at a "#" after whitespace and are trimmed. Single quoted values are taken as
+// written, while double quoted values read \n, \r, \t, \" and \\ as escapes.
+// Quoted values may span lines. Variables aren't expanded.
+func parseDotenv(content []byte) ([]dotenvPair, error) {
+	text := strings.Replace(string(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))), "\r\n", "\n", -1)
+	var pairs []dotenvPair
+	line := 1
+	for len(text) > 0 {
+		var current string
+		current, text = splitLine(text)
+		start := line
+		line++
+		current = strings.TrimSpace(current)
+		if current == "" || strings.HasPrefix(current, "#") {
+			continue
+		}
+		if strings.HasPrefix(current, "export ") || strings.HasPrefix(current, "export\t") {
+			current = strings.TrimSpace(current[len("export"):])
+		}
+		eq := strings.Index(current, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected NAME=VALUE", start)
+		}
+		name := strings.TrimSpace(current[:eq])
+		if !dotenvName.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid name %q", start, name)
+		}
+		rest := strings.TrimLeft(current[eq+1:], " \t")
+
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			if i := inlineComment(rest); i >= 0 {
+				rest = rest[:i]
+			}
+			pairs = append(pairs, dotenvPair{name: name, value: strings.TrimSpace(rest)})
+			continue
+		}
+
+		// A quoted value runs to its closing quote, which may be lines later
+		quote := rest[0]
+		rest = rest[1:]
+		var value strings.Builder
+		for {
+			end := closingQuote(rest, quote)
+			if end >= 0 {
+				_, _ = value.WriteString(rest[:end])
+				rest = strings.TrimSpace(rest[end+1:])
+				break
+			}
+			if text == "" {
+				return nil, fmt.Errorf("line %d: unterminated %c quoted value", start, quote)
+			}
+			_, _ = value.WriteString(rest + "\n")
+			rest, text = splitLine(text)
+			line++
+		}
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: unexpected %q after quoted value", start, rest)
+		}
+		v := value.String()
+		if quote == '"' {
+			v = unescapeDotenv(v)
+		}
+		pairs = append(pairs, dotenvPair{name: name, value: v})
+	}
+	return pairs, nil
+}
+
+// splitLine returns the first line of text and the text after it
+func splitLine(text string) (string, string) {
+	if i := strings.Index(text, "\n"); i >= 0 {
+		return text[:i], text[i+1:]
+	}
+	return text, ""
+}
+
+// inlineComment returns where a comment starts in an unquoted value, or -1
+func inlineComment(value string) int {
+	for i := 1; i < len(value); i++ {
+		if value[i] == '#' && (value[i-1] == ' ' || value[i-1] == '\t') {
+			return i
+		}
+	}
+	return -1
+}
+
+// closingQuote returns the index of the quote ending s, or -1. Backslashes
+// escape the next character in double quoted values.
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// dotenvEscapes are the escapes read in double quoted values
+var dotenvEscapes = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n", `\r`, "\r", `\t`, "\t")
+
+// unescapeDotenv reads the escapes in a double quoted value, leaving other
+// backslashes as written
+func unescapeDotenv(value string) string {
+	return dotenvEscapes.Replace(value)
+}
+
+// dotenvPlain matches values written without quotes
+var dotenvPlain = regexp.MustCompile(`^[A-Za-z0-9_./:@,+%=-]*$`)
+
+// encodeDotenv writes tree as a .env file, with nested names joined by dots
+// and values double quoted where they need it
+func encodeDotenv(tree map[string]interface{}) []byte {
+	values := make(map[string]string)
+	flattenDotted(values, "", tree)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		value := values[name]
+		if !dotenvPlain.MatchString(value) {
+			value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(value) + `"`
+		}
+		_, _ = buf.WriteString(name + "=" + value + "\n")
+	}
+	return buf.Bytes()
+}
+
+// flattenDotted sets the leaves of tree in values, with nested names joined by dots
+func flattenDotted(values map[string]string, prefix string, tree map[string]interface{}) {
+	for name, value := range tree {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenDotted(values, name, v)
+		case []interface{}:
+			values[name] = encodeJSON(v)
+		default:
+			values[name] = literalString(v)
+		}
+	}
+}
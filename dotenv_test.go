@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	cases := []struct {
+		content string
+		expect  []dotenvPair
+		err     string
+	}{
+		{"A=1\nB = two \n", []dotenvPair{{"A", "1"}, {"B", "two"}}, ""},
+		{"# comment\n\n  export A=1\nexport\tB=2\n", []dotenvPair{{"A", "1"}, {"B", "2"}}, ""},
+		{"A=value # comment\nB=a#b\nC=#\n", []dotenvPair{{"A", "value"}, {"B", "a#b"}, {"C", "#"}}, ""},
+		{"A=\nB=''\nC=\"\"\n", []dotenvPair{{"A", ""}, {"B", ""}, {"C", ""}}, ""},
+		{`A='it\n is $x'` + "\n" + `B="line\none\t\"q\" \\ \$x"`, []dotenvPair{{"A", `it\n is $x`}, {"B", "line\none\t\"q\" \\ \\$x"}}, ""},
+		{"A=\"first\nsecond\" # trailing\nB='x\n\ny'\r\nC=3", []dotenvPair{{"A", "first\nsecond"}, {"B", "x\n\ny"}, {"C", "3"}}, ""},
+		{"A=\"a 'b' c\"\nB='a \"b\" c'\n", []dotenvPair{{"A", "a 'b' c"}, {"B", `a "b" c`}}, ""},
+		{"\xef\xbb\xbfA=1\nA=2\napp.port=80\n", []dotenvPair{{"A", "1"}, {"A", "2"}, {"app.port", "80"}}, ""},
+		{"A=1\nnot a pair\n", nil, "line 2: expected NAME=VALUE"},
+		{"1A=1\n", nil, `line 1: invalid name "1A"`},
+		{"A=1\nB=\"open\n\nC=3\n", nil, "line 2: unterminated \" quoted value"},
+		{"A='x' y\n", nil, `line 1: unexpected "y" after quoted value`},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			actual, err := parseDotenv([]byte(tc.content))
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tc.expect) {
+				t.Errorf("expected %q, got %q", tc.expect, actual)
+			}
+		})
+	}
+
+	// Encoded values read back unchanged
+	tree := map[string]interface{}{"PLAIN": "a/b:c", "SPACED": "a b # c", "QUOTED": `say "hi" \ 'bye'`, "LINES": "one\ntwo\r\n", "EMPTY": "", "app": map[string]interface{}{"port": "80"}}
+	pairs, err := parseDotenv(encodeDotenv(tree))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := make(map[string]string)
+	for _, pair := range pairs {
+		decoded[pair.name] = pair.value
+	}
+	expect := map[string]string{"PLAIN": "a/b:c", "SPACED": "a b # c", "QUOTED": `say "hi" \ 'bye'`, "LINES": "one\ntwo\r\n", "EMPTY": "", "app.port": "80"}
+	if !reflect.DeepEqual(decoded, expect) {
+		t.Errorf("expected %q, got %q", expect, decoded)
+	}
+}
+
+func TestDotenvFiles(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"default.env":     "REGION=us\n",
+		".env":            "export LOG_LEVEL=info\n",
+		"app/.env":        "PORT=8080\nREGION=eu\n",
+		"app/db.env":      "# database\nURL=\"postgres://db/app\"\npool.size=5\n",
+		"app/default.env": "TIMEOUT='30s'\n",
+		"app/.hidden":     "skipped",
+	})
+	os.Clearenv()
+	err := os.Setenv("D2C_DIRECTORY", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	var actual bytes.Buffer
+	err = runRender(&actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A .env file holds its directory's keys, and default files apply to it as to any other
+	expect := "dir2consul/LOG_LEVEL : info\n" +
+		"dir2consul/REGION : us\n" +
+		"dir2consul/app/PORT : 8080\n" +
+		"dir2consul/app/REGION : eu\n" +
+		"dir2consul/app/TIMEOUT : 30s\n" +
+		"dir2consul/app/db/REGION : us\n" +
+		"dir2consul/app/db/TIMEOUT : 30s\n" +
+		"dir2consul/app/db/URL : postgres://db/app\n" +
+		"dir2consul/app/db/pool/size : 5\n"
+	if actual.String() != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, actual.String())
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/hashicorp/consul/api"
+	"github.com/magiconair/properties"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// exportFile is a file the export writes, with its path relative to DIRECTORY
+type exportFile struct {
+	path    string
+	content []byte
+	keys    int
+}
+
+// foldedName matches key names that survive being folded into a file: dots
+// nest in properties files, and LOWERCASE_KEYS changes capital letters
+var foldedName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// runExport writes the keys under CONSUL_KEY_PREFIX to files under DIRECTORY
+// that load back to the same keys. Leaf keys become files holding the value,
+// and with EXPORT_FORMAT set to yaml, json or properties, the keys directly
+// below a path are folded into a single file of that format where possible.
+// DIRECTORY must be empty or not exist.
+func runExport(consulClient *api.Client) error {
+	if viper.GetString("DEFAULT_CONFIG_TYPE") != "" {
+		return fmt.Errorf("Can't export with D2C_DEFAULT_CONFIG_TYPE set: files without an extension would not load as values")
+	}
+	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
+	if err != nil {
+		return err
+	}
+
+	dir := viper.GetString("DIRECTORY")
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("Refusing to export into %s because it isn't empty", dir)
+	}
+
+	_, consulPairs, err := loadKeyValuesFromConsul(consulClient)
+	if err != nil {
+		return err
+	}
+	// Folders made in the Consul UI are empty keys ending in "/". Directories stand in for them.
+	for key, pair := range consulPairs {
+		if strings.HasSuffix(key, "/") && len(pair.Value) == 0 {
+			log.Printf("Skipping folder %s", key)
+			delete(consulPairs, key)
+		}
+	}
+	files, err := planExport(sortedPairs(consulPairs), viper.GetString("EXPORT_FORMAT"), dirIgnoreRe, fileIgnoreRe)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if viper.GetBool("DRYRUN") || viper.GetBool("VERBOSE") {
+			log.Printf("Exporting %d keys to %s", f.keys, filepath.Join(dir, f.path))
+		}
+		if viper.GetBool("DRYRUN") {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, f.path)), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, f.path), f.content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if viper.GetBool("DRYRUN") {
+		return nil
+	}
+
+	// Prove the round trip by loading the tree back
+	exported := kv.NewList()
+	report, err := loadKeyValuesFromDisk(exported, dirIgnoreRe, fileIgnoreRe)
+	if err != nil {
+		return err
+	}
+	err = problemsError(report.problems)
+	if err != nil {
+		return err
+	}
+	err = compareExport(consulPairs, exported)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d keys under %s to %d files in %s", len(consulPairs), viper.GetString("CONSUL_KEY_PREFIX"), len(files), dir)
+	return nil
+}
+
+// planExport decides which file each pair goes to. It fails, listing the keys,
+// when some keys can't be written as files that load back unchanged.
+func planExport(pairs api.KVPairs, format string, dirIgnoreRe *regexp.Regexp, fileIgnoreRe *regexp.Regexp) ([]exportFile, error) {
+	switch format {
+	case "blob", "json", "properties", "yaml":
+	default:
+		return nil, fmt.Errorf("Unknown D2C_EXPORT_FORMAT value %q: use blob, json, properties or yaml", format)
+	}
+
+	var problems []string
+	groups := make(map[string]map[string]string)
+	var blobs []string
+	values := make(map[string][]byte)
+	for _, pair := range pairs {
+		rel := relativeKey(pair.Key)
+		if problem := exportProblem(pair.Key, pair.Value, dirIgnoreRe, fileIgnoreRe); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", pair.Key, problem))
+			continue
+		}
+		values[rel] = pair.Value
+		parent, name := path.Split(rel)
+		parent = strings.TrimSuffix(parent, "/")
+		folded := path.Base(parent) + "." + format
+		lowercased := viper.GetBool("LOWERCASE_KEYS") && name != strings.ToLower(name)
+		if format != "blob" && parent != "" && foldedName.MatchString(name) && !lowercased && path.Base(parent) != "default" && !fileIgnoreRe.MatchString(folded) {
+			if groups[parent] == nil {
+				groups[parent] = make(map[string]string)
+			}
+			groups[parent][name] = string(pair.Value)
+			continue
+		}
+		blobs = append(blobs, rel)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Can't export %d keys so they load back unchanged:\n\t%s", len(problems), strings.Join(problems, "\n\t"))
+	}
+
+	var files []exportFile
+	for parent, group := range groups {
+		content, err := foldGroup(group, format)
+		if err != nil {
+			return nil, err
+		}
+		if content == nil {
+			// The values don't survive the format, so keep them as blobs
+			for name := range group {
+				blobs = append(blobs, parent+"/"+name)
+			}
+			continue
+		}
+		files = append(files, exportFile{path: filepath.FromSlash(parent + "." + format), content: content, keys: len(group)})
+	}
+	for _, rel := range blobs {
+		files = append(files, exportFile{path: filepath.FromSlash(rel), content: values[rel], keys: 1})
+	}
+
+	// A value can't be a file and a directory at once
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	paths := make(map[string]bool, len(files))
+	for _, f := range files {
+		paths[f.path] = true
+	}
+	conflicts := make(map[string]bool)
+	for _, f := range files {
+		for dir := filepath.Dir(f.path); dir != "."; dir = filepath.Dir(dir) {
+			if paths[dir] && !conflicts[dir] {
+				conflicts[dir] = true
+				problems = append(problems, fmt.Sprintf("%s: is a value and has keys below it", dir))
+			}
+		}
+	}
+	sort.Strings(problems)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Can't export %d keys so they load back unchanged:\n\t%s", len(problems), strings.Join(problems, "\n\t"))
+	}
+	return files, nil
+}
+
+// exportProblem explains why key can't be written as a file that loads back
+// as the same key, or returns ""
+func exportProblem(key string, value []byte, dirIgnoreRe *regexp.Regexp, fileIgnoreRe *regexp.Regexp) string {
+	if !strings.HasPrefix(key, viper.GetString("CONSUL_KEY_PREFIX")+"/") {
+		return "is not under D2C_CONSUL_KEY_PREFIX"
+	}
+	rel := relativeKey(key)
+	if rel == "" || strings.HasSuffix(rel, "/") {
+		return "is a folder with a value"
+	}
+	if len(value) > 512000 {
+		return "value exceeds the 512KB dir2consul loads"
+	}
+	segments := strings.Split(rel, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "" || segment == "." || segment == "..":
+			return "has an empty or relative path segment"
+		case strings.HasPrefix(segment, "."):
+			return "hidden files and directories aren't loaded"
+		case i < len(segments)-1 && dirIgnoreRe.MatchString(strings.Join(segments[:i+1], "/")):
+			return "directory matches D2C_IGNORE_DIR_REGEX"
+		}
+	}
+	name := segments[len(segments)-1]
+	switch {
+	case filepath.Ext(name) != "":
+		return "the file extension would be dropped from the key"
+	case name == "default":
+		return "would be loaded as a default file"
+	case fileIgnoreRe.MatchString(name):
+		return "file matches D2C_IGNORE_FILE_REGEX"
+	}
+	return ""
+}
+
+// foldGroup renders group in format. It returns nil when loading the result
+// back wouldn't give exactly the same keys and values.
+func foldGroup(group map[string]string, format string) ([]byte, error) {
+	var content []byte
+	var err error
+	switch format {
+	case "json":
+		content, err = json.MarshalIndent(group, "", "  ")
+		content = append(content, '\n')
+	case "yaml":
+		content, err = yaml.Marshal(group)
+	case "properties":
+		p := properties.NewProperties()
+		names := make([]string, 0, len(group))
+		for name := range group {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			_, _, err = p.Set(name, group[name])
+			if err != nil {
+				return nil, err
+			}
+		}
+		var buf bytes.Buffer
+		_, err = p.Write(&buf, properties.UTF8)
+		content = buf.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Load it the way loadKeyValuesFromDisk would
+	tmp, err := ioutil.TempDir("", "dir2consul")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+	file := filepath.Join(tmp, "fold."+format)
+	err = ioutil.WriteFile(file, content, 0600)
+	if err != nil {
+		return nil, err
+	}
+	v, err := mergeConfiguration([]string{file})
+	if err != nil || len(v.AllKeys()) != len(group) {
+		return nil, nil
+	}
+	for _, key := range v.AllKeys() {
+		value, ok := group[key]
+		if !ok || v.GetString(key) != value {
+			return nil, nil
+		}
+	}
+	return content, nil
+}
+
+// compareExport checks the exported tree loaded back to the Consul data
+func compareExport(consulPairs map[string]*api.KVPair, exported *kv.List) error {
+	var problems []string
+	for key, pair := range consulPairs {
+		_, value, err := exported.Get(key, nil)
+		switch {
+		case err == kv.ErrNxKey:
+			problems = append(problems, key+": missing")
+		case err != nil:
+			return err
+		case !bytes.Equal(value, pair.Value):
+			problems = append(problems, key+": different value")
+		}
+	}
+	for _, key := range exported.Keys() {
+		if consulPairs[key] == nil {
+			problems = append(problems, key+": not in Consul")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("The exported files don't load back to the same keys:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
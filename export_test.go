@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// exportData has values that are awkward to fold: look-alike numbers and
+// booleans, empty and multi-line values, and names viper would change
+var exportData = map[string]string{
+	"dir2consul/app/name":            "billing",
+	"dir2consul/app/port":            "007",
+	"dir2consul/app/enabled":         "true",
+	"dir2consul/app/empty":           "",
+	"dir2consul/app/motd":            "hello\n  world  \n",
+	"dir2consul/app/Mixed_Case":      "kept",
+	"dir2consul/app/db/url":          "postgres://db:5432/billing?sslmode=require",
+	"dir2consul/certs/ca":            "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	"dir2consul/top":                 "level",
+	"dir2consul/default/inherited":   "no",
+	"dir2consul/web.d/listen":        ":8080",
+	"dir2consul/unicode/greeting":    "héllo wörld ☃",
+	"dir2consul/app/db/quote-string": `"quoted" 'both' = : #`,
+}
+
+func TestExport(t *testing.T) {
+	cases := []struct {
+		format string
+		expect []string
+	}{
+		{"blob", []string{"app/name", "app/db/url", "default/inherited", "top"}},
+		{"json", []string{"app.json", "app/db.json", "default/inherited", "top"}},
+		{"properties", []string{"app.properties", "app/db.properties", "top"}},
+		{"yaml", []string{"app.yaml", "app/db.yaml", "default/inherited", "top"}},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.format), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "export")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			os.Clearenv()
+			err = os.Setenv("D2C_DIRECTORY", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_EXPORT_FORMAT", tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			// Folders made in the Consul UI are skipped
+			data := map[string]string{"dir2consul/app/db/": ""}
+			for k, v := range exportData {
+				data[k] = v
+			}
+			_, client := newFakeConsul(t, data)
+			err = runExport(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range tc.expect {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file))); err != nil {
+					t.Errorf("expected %s to be exported: %v", file, err)
+				}
+			}
+
+			// Syncing the export back changes nothing
+			fake, client := newFakeConsul(t, exportData)
+			err = runSync(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fake.txns != 0 {
+				t.Errorf("syncing the export back made %d transactions", fake.txns)
+			}
+		})
+	}
+}
+
+func TestExportProblems(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   map[string]string
+		expect string
+	}{
+		{"extension", map[string]string{"dir2consul/app/config.json": "{}"}, "the file extension would be dropped"},
+		{"default", map[string]string{"dir2consul/app/default": "x"}, "would be loaded as a default file"},
+		{"hidden", map[string]string{"dir2consul/.git/config": "x"}, "hidden files"},
+		{"ignored", map[string]string{"dir2consul/README": "x"}, "D2C_IGNORE_FILE_REGEX"},
+		{"value and directory", map[string]string{"dir2consul/app": "x", "dir2consul/app/port": "1"}, "is a value and has keys below it"},
+		{"value and directory apart", map[string]string{"dir2consul/app": "x", "dir2consul/app-x": "x", "dir2consul/app/y": "1"}, "app: is a value and has keys below it"},
+		{"folder with value", map[string]string{"dir2consul/app/": "x"}, "is a folder with a value"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "export")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			os.Clearenv()
+			err = os.Setenv("D2C_DIRECTORY", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_IGNORE_FILE_REGEX", "README")
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			_, client := newFakeConsul(t, tc.data)
+			err = runExport(client)
+			if err == nil || !strings.Contains(err.Error(), tc.expect) {
+				t.Fatalf("expected an error containing %q, got %v", tc.expect, err)
+			}
+			files, _ := ioutil.ReadDir(dir)
+			if len(files) != 0 {
+				t.Errorf("nothing should be written when the export fails, found %d files", len(files))
+			}
+		})
+	}
+}
+
+func TestPlanExportFileAndDirectory(t *testing.T) {
+	os.Clearenv()
+	setupEnvironment()
+
+	// app.yaml and app-x sort between app and app/db.yaml
+	pairs := api.KVPairs{
+		{Key: "dir2consul/app", Value: []byte("x")},
+		{Key: "dir2consul/app-x", Value: []byte("x")},
+		{Key: "dir2consul/app/port", Value: []byte("1")},
+		{Key: "dir2consul/app/db/host", Value: []byte("h")},
+	}
+	_, err := planExport(pairs, "yaml", regexp.MustCompile(`a^`), regexp.MustCompile(`a^`))
+	if err == nil || !strings.Contains(err.Error(), "app: is a value and has keys below it") {
+		t.Errorf("expected app to be reported, got %v", err)
+	}
+}
+
+func TestExportNeighbourPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	os.Clearenv()
+	for k, v := range map[string]string{"D2C_DIRECTORY": dir, "D2C_CONSUL_KEY_PREFIX": "config/app"} {
+		err = os.Setenv(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupEnvironment()
+
+	// Keys of a neighbouring prefix are neither listed nor written
+	_, client := newFakeConsul(t, map[string]string{"config/app/a": "1", "config/app-v2/b": "2"})
+	err = runExport(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "a" {
+		t.Errorf("expected only the file a, got %v", files)
+	}
+
+	// And a key outside the prefix is refused before anything is written
+	_, err = planExport(api.KVPairs{{Key: "config/app-v2/b", Value: []byte("2")}}, "blob", regexp.MustCompile(`a^`), regexp.MustCompile(`a^`))
+	if err == nil || !strings.Contains(err.Error(), "config/app-v2/b: is not under D2C_CONSUL_KEY_PREFIX") {
+		t.Errorf("expected config/app-v2/b to be refused, got %v", err)
+	}
+}
+
+func TestExportNotEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	err = ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Clearenv()
+	err = os.Setenv("D2C_DIRECTORY", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	_, client := newFakeConsul(t, exportData)
+	err = runExport(client)
+	if err == nil || !strings.Contains(err.Error(), "isn't empty") {
+		t.Fatalf("expected a refusal to export into a non-empty directory, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul is a minimal in-memory stand in for the Consul KV, Txn and Session HTTP APIs
+type fakeConsul struct {
+	sync.Mutex
+	server *httptest.Server
+	index  uint64
+	kvs    map[string]*api.KVPair
+	txns   int
+	// failTxn, when set, is called before each transaction and may return an error message to fail it with a 500
+	failTxn func(n int) string
+	// loseTxn, when set, is called after each transaction is applied and may have its response lost as a 500
+	loseTxn func(n int) bool
+	// beforeTxn, when set, is called before each transaction is handled, for example to simulate a concurrent edit
+	beforeTxn func()
+}
+
+// newFakeConsul starts a fakeConsul holding kvs and returns it with a client connected to it
+func newFakeConsul(t *testing.T, kvs map[string]string) (*fakeConsul, *api.Client) {
+	f := &fakeConsul{kvs: make(map[string]*api.KVPair)}
+	for k, v := range kvs {
+		f.index++
+		f.kvs[k] = &api.KVPair{Key: k, Value: []byte(v), CreateIndex: f.index, ModifyIndex: f.index}
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	config := api.DefaultConfig()
+	config.Address = f.server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+// values returns a copy of the stored keys and values
+func (f *fakeConsul) values() map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	values := make(map[string]string)
+	for k, p := range f.kvs {
+		values[k] = string(p.Value)
+	}
+	return values
+}
+
+// set stores a value as if another Consul client wrote it
+func (f *fakeConsul) set(key string, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	p, ok := f.kvs[key]
+	if !ok {
+		p = &api.KVPair{Key: key, CreateIndex: f.index}
+		f.kvs[key] = p
+	}
+	p.Value = []byte(value)
+	p.ModifyIndex = f.index
+}
+
+// delete removes a key as if another Consul client deleted it
+func (f *fakeConsul) delete(key string) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	delete(f.kvs, key)
+}
+
+// session returns the session holding key, if any
+func (f *fakeConsul) session(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	if p, ok := f.kvs[key]; ok {
+		return p.Session
+	}
+	return ""
+}
+
+// lockedBy stores key as a Consul lock held by session
+func (f *fakeConsul) lockedBy(key string, session string, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	f.kvs[key] = &api.KVPair{Key: key, Value: []byte(value), Flags: api.LockFlagValue, Session: session, CreateIndex: f.index, ModifyIndex: f.index}
+}
+
+func (f *fakeConsul) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/txn" && f.beforeTxn != nil {
+		f.beforeTxn()
+	}
+	if r.URL.Query().Get("index") != "" {
+		// Stand in for a blocking query by waiting a little, without holding the lock
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil || wait > 50*time.Millisecond {
+			wait = 50 * time.Millisecond
+		}
+		time.Sleep(wait)
+	}
+	f.Lock()
+	defer f.Unlock()
+	_, recurse := r.URL.Query()["recurse"]
+	switch {
+	case r.URL.Path == "/v1/txn" && r.Method == http.MethodPut:
+		f.handleTxn(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == http.MethodGet && recurse:
+		f.handleList(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == http.MethodGet:
+		f.handleGet(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == http.MethodPut:
+		f.handlePut(w, r)
+	case r.URL.Path == "/v1/session/create":
+		f.index++
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": fmt.Sprintf("session-%d", f.index)})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		_ = json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: strings.TrimPrefix(r.URL.Path, "/v1/session/renew/"), TTL: "15s"}})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		_, _ = w.Write([]byte("true"))
+	default:
+		http.Error(w, "unsupported request "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeConsul) handleGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	p, ok := f.kvs[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(api.KVPairs{p})
+}
+
+// handlePut supports plain and check-and-set writes, and the acquire and release writes used by Consul locks
+func (f *fakeConsul) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	value, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flags, _ := strconv.ParseUint(r.URL.Query().Get("flags"), 10, 64)
+	p, exists := f.kvs[key]
+	if acquire := r.URL.Query().Get("acquire"); acquire != "" {
+		if exists && p.Session != "" && p.Session != acquire {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		f.index++
+		f.kvs[key] = &api.KVPair{Key: key, Value: value, Flags: flags, Session: acquire, CreateIndex: f.index, ModifyIndex: f.index}
+		_, _ = w.Write([]byte("true"))
+		return
+	}
+	if release := r.URL.Query().Get("release"); release != "" {
+		if !exists || p.Session != release {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		f.index++
+		p.Session = ""
+		p.ModifyIndex = f.index
+		_, _ = w.Write([]byte("true"))
+		return
+	}
+	if cas := r.URL.Query().Get("cas"); cas != "" {
+		index, _ := strconv.ParseUint(cas, 10, 64)
+		if (exists && p.ModifyIndex != index) || (!exists && index != 0) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+	}
+	f.index++
+	if !exists {
+		p = &api.KVPair{Key: key, CreateIndex: f.index}
+		f.kvs[key] = p
+	}
+	p.Value = value
+	p.Flags = flags
+	p.ModifyIndex = f.index
+	_, _ = w.Write([]byte("true"))
+}
+
+func (f *fakeConsul) handleList(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	var pairs api.KVPairs
+	for k, p := range f.kvs {
+		if strings.HasPrefix(k, prefix) {
+			pairs = append(pairs, p)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(pairs)
+}
+
+func (f *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	f.txns++
+	if f.failTxn != nil {
+		if msg := f.failTxn(f.txns); msg != "" {
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var ops api.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Work on a copy so a failed transaction leaves nothing behind
+	staged := make(map[string]*api.KVPair)
+	for k, p := range f.kvs {
+		c := *p
+		staged[k] = &c
+	}
+	index := f.index + 1
+	var resp api.TxnResponse
+	for i, op := range ops {
+		kvOp := op.KV
+		existing, exists := staged[kvOp.Key]
+		switch kvOp.Verb {
+		case api.KVSet, api.KVCAS:
+			if kvOp.Verb == api.KVCAS && ((exists && existing.ModifyIndex != kvOp.Index) || (!exists && kvOp.Index != 0)) {
+				resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: fmt.Sprintf("failed to set key %q, index is stale", kvOp.Key)})
+				continue
+			}
+			if !exists {
+				existing = &api.KVPair{Key: kvOp.Key, CreateIndex: index}
+				staged[kvOp.Key] = existing
+			}
+			existing.Value = kvOp.Value
+			existing.Flags = kvOp.Flags
+			existing.ModifyIndex = index
+		case api.KVDelete, api.KVDeleteCAS:
+			if kvOp.Verb == api.KVDeleteCAS && (!exists || existing.ModifyIndex != kvOp.Index) {
+				resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: fmt.Sprintf("failed to delete key %q, index is stale", kvOp.Key)})
+				continue
+			}
+			delete(staged, kvOp.Key)
+		case api.KVDeleteTree:
+			for k := range staged {
+				if strings.HasPrefix(k, kvOp.Key) {
+					delete(staged, k)
+				}
+			}
+		default:
+			resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: "unsupported verb " + string(kvOp.Verb)})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.Errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	f.kvs = staged
+	f.index = index
+	if f.loseTxn != nil && f.loseTxn(f.txns) {
+		http.Error(w, "connection reset", http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
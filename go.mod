@@ -3,11 +3,18 @@ module github.com/code42/dir2consul
 go 1.15
 
 require (
-	github.com/armon/go-metrics v0.3.4 // indirect
+	github.com/armon/go-metrics v0.3.4
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/hashicorp/consul/api v1.9.1
 	github.com/hashicorp/go-hclog v0.14.1 // indirect
 	github.com/hashicorp/go-immutable-radix v1.2.0 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
+	github.com/hashicorp/hcl v1.0.0
+	github.com/magiconair/properties v1.8.5
 	github.com/mattn/go-colorable v0.1.7 // indirect
+	github.com/pelletier/go-toml v1.9.3
+	github.com/spf13/cast v1.3.1
 	github.com/spf13/viper v1.8.1
+	gopkg.in/ini.v1 v1.62.0
+	gopkg.in/yaml.v2 v2.4.0
 )
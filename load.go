@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/spf13/viper"
+)
+
+// maxValueSize is the largest value dir2consul loads, a little under Consul's 512KB limit
+const maxValueSize = 512000
+
+// parseError is a file that failed to load, and the parser that failed on it
+type parseError struct {
+	path   string
+	parser string
+	err    error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("%s: %s parser: %v", e.path, e.parser, e.err)
+}
+
+// parserName returns the name of the parser loadFile uses for path
+func parserName(path string) string {
+	switch filetype := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."); filetype {
+	case "env", "hcl", "ini", "json", "properties", "toml", "yaml", "yml":
+		return filetype
+	}
+	if viper.GetString("DEFAULT_CONFIG_TYPE") != "" {
+		return viper.GetString("DEFAULT_CONFIG_TYPE")
+	}
+	return "blob"
+}
+
+// problemKind sorts loading problems by how a sync treats them
+type problemKind int
+
+const (
+	// problemInvalid is data Consul can't take, or files dir2consul can't make sense of. Syncs always stop.
+	problemInvalid problemKind = iota
+	// problemLoad is a file that failed to load and was skipped. Syncs stop in strict mode.
+	problemLoad
+	// problemCollision is a key loaded from more than one file
+	problemCollision
+	// problemKey is a key Consul takes but that is likely a mistake. It is still written. Syncs stop in strict mode.
+	problemKey
+)
+
+// loadProblem is something wrong with a file found while loading
+type loadProblem struct {
+	path    string
+	message string
+	kind    problemKind
+}
+
+// keySource is a file that set a key, relative to DIRECTORY, and the value it set
+type keySource struct {
+	File  string
+	Value string
+}
+
+// loadReport collects the problems found by loadKeyValuesFromDisk, which
+// carries on past them so all of them can be reported at once
+type loadReport struct {
+	problems []loadProblem
+	// sources maps each key loaded to the file it came from
+	sources map[string]string
+	// provenance maps each key loaded to every file that set it, in
+	// precedence order, including the default files merged into it
+	provenance map[string][]keySource
+	// rollups maps the key of each directory rolled up into one value to
+	// the keys loaded below it, and rollupPaths maps it to the directory
+	rollups     map[string]*kv.List
+	rollupPaths map[string]string
+}
+
+func newLoadReport() *loadReport {
+	return &loadReport{
+		sources:     make(map[string]string),
+		provenance:  make(map[string][]keySource),
+		rollups:     make(map[string]*kv.List),
+		rollupPaths: make(map[string]string),
+	}
+}
+
+// addRollup rolls the keys below the directory path up into one value, unless
+// a directory above it is already rolled up
+func (r *loadReport) addRollup(path string) {
+	key := viper.GetString("CONSUL_KEY_PREFIX") + "/" + filepath.ToSlash(path)
+	if r.rollupOf(key) != "" {
+		return
+	}
+	if viper.GetBool("VERBOSE") {
+		log.Printf("Rolling %s up into %s", path, key)
+	}
+	r.rollups[key] = kv.NewList()
+	r.rollupPaths[key] = path
+}
+
+// rollupOf returns the key of the rolled up directory key is below, or ""
+func (r *loadReport) rollupOf(key string) string {
+	for rollup := range r.rollups {
+		if strings.HasPrefix(key, rollup+"/") {
+			return rollup
+		}
+	}
+	return ""
+}
+
+// finishRollups stores each rolled up directory in kvs as a JSON object
+// nesting the keys below it
+func (r *loadReport) finishRollups(kvs *kv.List) error {
+	rollups := make([]string, 0, len(r.rollups))
+	for rollup := range r.rollups {
+		rollups = append(rollups, rollup)
+	}
+	sort.Strings(rollups)
+	for _, rollup := range rollups {
+		keys := r.rollups[rollup].Keys()
+		sort.Strings(keys)
+		values := make(map[string]string, len(keys))
+		// Each file's part of the object, in the order the files first appear
+		var files []string
+		parts := make(map[string]map[string]string)
+		for _, key := range keys {
+			_, value, err := r.rollups[rollup].Get(key, nil)
+			if err != nil {
+				return err
+			}
+			name := strings.TrimPrefix(key, rollup+"/")
+			values[name] = string(value)
+			for _, source := range r.provenance[key] {
+				if parts[source.File] == nil {
+					parts[source.File] = make(map[string]string)
+					files = append(files, source.File)
+				}
+				parts[source.File][name] = source.Value
+			}
+		}
+
+		// Defaults also apply below files loaded whole, which an object can't hold
+		for name := range values {
+			if belowValue(values, name) && fromDefaults(r.provenance[rollup+"/"+name]) {
+				delete(values, name)
+				for file := range parts {
+					delete(parts[file], name)
+				}
+			}
+		}
+
+		object, problem := nestKeys(values)
+		if problem != "" {
+			r.add(r.rollupPaths[rollup], problemInvalid, "can't roll up into %s: %s", rollup, problem)
+			continue
+		}
+		var from []keySource
+		for _, file := range files {
+			part, _ := nestKeys(parts[file])
+			from = append(from, keySource{File: file, Value: encodeJSON(part)})
+		}
+		err := r.set(kvs, r.rollupPaths[rollup], rollup, []byte(encodeJSON(object)), from)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// belowValue is true when a key above name, joined by "/", has a value
+func belowValue(values map[string]string, name string) bool {
+	for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+		if _, ok := values[name[:i]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fromDefaults is true when only default files set a key
+func fromDefaults(sources []keySource) bool {
+	for _, source := range sources {
+		base := filepath.Base(source.File)
+		if base != "default" && base != "default"+filepath.Ext(base) {
+			return false
+		}
+	}
+	return len(sources) > 0
+}
+
+// nestKeys turns keys joined by "/" into nested objects, or explains why it can't
+func nestKeys(values map[string]string) (map[string]interface{}, string) {
+	object := make(map[string]interface{})
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := strings.Split(name, "/")
+		node := object
+		for i, segment := range path[:len(path)-1] {
+			next, ok := node[segment].(map[string]interface{})
+			if !ok {
+				if _, isValue := node[segment]; isValue {
+					return nil, fmt.Sprintf("%s has a value and keys below it", strings.Join(path[:i+1], "/"))
+				}
+				next = make(map[string]interface{})
+				node[segment] = next
+			}
+			node = next
+		}
+		if _, ok := node[path[len(path)-1]]; ok {
+			return nil, fmt.Sprintf("%s has a value and keys below it", name)
+		}
+		node[path[len(path)-1]] = values[name]
+	}
+	return object, ""
+}
+
+// widen adds to scope the rolled up directories that hold any key in it, since
+// their values change when a key below them does
+func (r *loadReport) widen(scope keyScope) keyScope {
+	for rollup := range r.rollups {
+		for _, key := range scope {
+			if strings.HasPrefix(key, rollup+"/") {
+				scope = append(scope, rollup)
+				break
+			}
+		}
+	}
+	return scope
+}
+
+// add records a problem with path
+func (r *loadReport) add(path string, kind problemKind, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if viper.GetBool("VERBOSE") {
+		log.Printf("Problem with %s: %s", path, message)
+	}
+	r.problems = append(r.problems, loadProblem{path: path, message: message, kind: kind})
+}
+
+// set validates key and value before storing them in kvs as loaded from path,
+// with from being the files that set the value
+func (r *loadReport) set(kvs *kv.List, path string, key string, value []byte, from []keySource) error {
+	if problem, kind := keyProblem(key); problem != "" {
+		r.add(path, kind, "invalid key %q: %s", key, problem)
+		if kind == problemInvalid {
+			return nil
+		}
+	}
+	if len(value) > maxValueSize {
+		r.add(path, problemLoad, "value of %s is %d bytes, over the %d byte limit", key, len(value), maxValueSize)
+		return nil
+	}
+	if source, ok := r.sources[key]; ok && source != path {
+		if viper.GetString("ON_COLLISION") != "precedence" {
+			r.add(path, problemCollision, "key %s is also loaded from %s", key, source)
+		} else if outranks(source, path) {
+			if viper.GetBool("VERBOSE") {
+				log.Printf("Key %s from %s takes precedence over %s", key, source, path)
+			}
+			// The losing file still set the key, so it goes first in precedence order
+			var lost []keySource
+			for _, s := range from {
+				if !hasSource(r.provenance[key], s.File) {
+					lost = append(lost, s)
+				}
+			}
+			r.provenance[key] = append(lost, r.provenance[key]...)
+			return nil
+		} else if viper.GetBool("VERBOSE") {
+			log.Printf("Key %s from %s takes precedence over %s", key, path, source)
+		}
+	}
+	r.sources[key] = path
+	// A key loaded again by another file keeps the files that set it before,
+	// since the walk order decided which file won. Default files shared by
+	// both are listed once.
+	for _, source := range from {
+		if !hasSource(r.provenance[key], source.File) {
+			r.provenance[key] = append(r.provenance[key], source)
+		}
+	}
+	// Keys below a rolled up directory wait to be folded into its value
+	if rollup := r.rollupOf(key); rollup != "" {
+		kvs = r.rollups[rollup]
+	}
+	_, _, err := kvs.Set(key, value)
+	return err
+}
+
+// setDocument stores the files merged into v as a single value under key,
+// encoded by DOCUMENT_FORMAT with filetype as the source format. root is DIRECTORY.
+func (r *loadReport) setDocument(kvs *kv.List, root string, path string, key string, v *configValues, filetype string) error {
+	value, err := v.document(filetype)
+	if err != nil {
+		r.add(path, problemLoad, "can't store as a single %s document: %v", filetype, err)
+		return nil
+	}
+	if viper.GetBool("VERBOSE") {
+		log.Printf("%s=%s", key, redact(key, value))
+	}
+	var from []keySource
+	for _, layer := range v.layers {
+		if len(layer.tree) == 0 {
+			continue
+		}
+		content, err := encodeDocument(layer.tree, filetype)
+		if err != nil {
+			r.add(path, problemLoad, "can't store as a single %s document: %v", filetype, err)
+			return nil
+		}
+		from = append(from, keySource{File: relativePath(root, layer.file), Value: string(content)})
+	}
+	return r.set(kvs, path, key, value, from)
+}
+
+// outranks reports whether the value a file at path a sets for a key wins over
+// the one set by b, when ON_COLLISION is precedence. Files are ranked by their
+// extension's place in COLLISION_PRECEDENCE, with unlisted extensions last,
+// then the more deeply nested file wins, then the path that sorts first.
+func outranks(a string, b string) bool {
+	rank := func(path string) int {
+		ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		for i, listed := range strings.Split(viper.GetString("COLLISION_PRECEDENCE"), ",") {
+			if strings.TrimSpace(listed) == ext {
+				return i
+			}
+		}
+		return len(strings.Split(viper.GetString("COLLISION_PRECEDENCE"), ","))
+	}
+	if rank(a) != rank(b) {
+		return rank(a) < rank(b)
+	}
+	depthA, depthB := strings.Count(filepath.ToSlash(a), "/"), strings.Count(filepath.ToSlash(b), "/")
+	if depthA != depthB {
+		return depthA > depthB
+	}
+	return a < b
+}
+
+// check returns an error listing the problems that should stop a sync: invalid
+// data, collisions when ON_COLLISION is error and, when strict, files that
+// failed to load and suspect keys. The rest are logged.
+func (r *loadReport) check(strict bool) error {
+	var failed []loadProblem
+	for _, p := range r.problems {
+		if p.kind == problemInvalid || strict && (p.kind == problemLoad || p.kind == problemKey) ||
+			p.kind == problemCollision && viper.GetString("ON_COLLISION") == "error" {
+			failed = append(failed, p)
+			continue
+		}
+		log.Printf("Warning: %s: %s", p.path, p.message)
+	}
+	return problemsError(failed)
+}
+
+// problemsError returns an error listing problems, or nil when there are none
+func problemsError(problems []loadProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	lines := make([]string, 0, len(problems))
+	for _, p := range problems {
+		lines = append(lines, p.path+": "+p.message)
+	}
+	sort.Strings(lines)
+	return fmt.Errorf("Problems loading %s:\n\t%s", viper.GetString("DIRECTORY"), strings.Join(lines, "\n\t"))
+}
+
+// keyProblem explains what is wrong with key, or returns "". Keys that aren't
+// valid UTF-8 can't be sent to Consul unchanged and are problemInvalid. Other
+// odd shapes, such as the empty segment in a URL used as a key, are stored by
+// Consul as written and are problemKey.
+func keyProblem(key string) (string, problemKind) {
+	switch {
+	case !utf8.ValidString(key):
+		return "not valid UTF-8", problemInvalid
+	case strings.HasPrefix(key, "/"):
+		return "starts with /", problemKey
+	case strings.HasSuffix(key, "/"):
+		return "ends with /", problemKey
+	case strings.Contains(key, "//"):
+		return "has an empty path segment", problemKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return "has a relative path segment", problemKey
+		}
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return "has a control character", problemKey
+		}
+	}
+	return "", problemKey
+}
+
+// addLoadError records that path failed to load. Parse errors name the file
+// that failed, which may be a default file above path. root is DIRECTORY.
+func (r *loadReport) addLoadError(root string, path string, err error) {
+	pe, ok := err.(*parseError)
+	if !ok {
+		r.add(path, problemLoad, "%v", err)
+		return
+	}
+	failed := relativePath(root, pe.path)
+	if failed == path {
+		r.add(path, problemLoad, "%s parser: %v", pe.parser, pe.err)
+		return
+	}
+	r.add(path, problemLoad, "default file %s: %s parser: %v", failed, pe.parser, pe.err)
+}
+
+// runValidate loads DIRECTORY without connecting to Consul and fails when any
+// file has a problem, listing them all
+func runValidate() error {
+	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
+	if err != nil {
+		return err
+	}
+
+	fileKeyValues := kv.NewList()
+	report, err := loadKeyValuesFromDisk(fileKeyValues, dirIgnoreRe, fileIgnoreRe)
+	if err != nil {
+		return err
+	}
+	err = problemsError(report.problems)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	for _, source := range report.sources {
+		files[source] = true
+	}
+	log.Printf("%s is valid: %d keys from %d files", viper.GetString("DIRECTORY"), len(report.sources), len(files))
+	return nil
+}
+
+// relativePath returns path relative to root when it can
+func relativePath(root string, path string) string {
+	if rel, err := filepath.Rel(root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// relativeSources returns sources with their files relative to root
+func relativeSources(root string, sources []keySource) []keySource {
+	relative := make([]keySource, 0, len(sources))
+	for _, source := range sources {
+		relative = append(relative, keySource{File: relativePath(root, source.File), Value: source.Value})
+	}
+	return relative
+}
+
+// hasSource reports whether file is one of sources
+func hasSource(sources []keySource, file string) bool {
+	for _, source := range sources {
+		if source.File == file {
+			return true
+		}
+	}
+	return false
+}
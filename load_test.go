@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/code42/dir2consul/kv"
+)
+
+// writeTree creates files, named by slash separated paths, under a new temporary directory
+func writeTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// symlinkTo returns a symlink to dir, the way git-sync publishes a checkout
+func symlinkTo(t *testing.T, dir string) string {
+	link := dir + "-link"
+	err := os.Symlink(dir, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(link) })
+	return link
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		files   map[string]string
+		expect  []string
+		symlink bool
+	}{
+		{
+			"valid",
+			map[string]string{"default.yaml": "region: us\n", "app/config.yaml": "port: 8080\n", "app/motd": "hello"},
+			nil,
+			false,
+		},
+		{
+			"parse errors",
+			map[string]string{"bad.json": `{"a": ]`, "bad.yaml": "a: b: c\n", "good.yaml": "a: b\n"},
+			[]string{"bad.json: json parser:", "bad.yaml: yaml parser:"},
+			false,
+		},
+		{
+			"broken default",
+			map[string]string{"app/default.yaml": "a: b: c\n", "app/config.yaml": "a: b\n"},
+			[]string{"app/config.yaml: default file app/default.yaml: yaml parser:"},
+			false,
+		},
+		{
+			"multiple defaults",
+			map[string]string{"app/default.yaml": "a: b\n", "app/default.json": `{"a": "b"}`, "app/config.yaml": "c: d\n"},
+			[]string{"app/config.yaml: Multiple default files found in"},
+			false,
+		},
+		{
+			"oversized",
+			map[string]string{"big": strings.Repeat("x", maxValueSize+1)},
+			[]string{"big: file is 512001 bytes"},
+			false,
+		},
+		{
+			"invalid key",
+			map[string]string{"app.yaml": "\"bad\\tkey\": 1\n"},
+			[]string{`app.yaml: invalid key "dir2consul/app/bad\tkey": has a control character`},
+			false,
+		},
+		{
+			"collision",
+			map[string]string{"app.yaml": "port: 8080\n", "app.json": `{"port": "9090"}`},
+			[]string{"app.yaml: key dir2consul/app/port is also loaded from app.json"},
+			false,
+		},
+		{
+			"symlinked directory",
+			map[string]string{"bad.yaml": "a: b: c\n", "app/default.yaml": "a: b: c\n", "app/config.yaml": "a: b\n"},
+			[]string{"bad.yaml: yaml parser:", "app/config.yaml: default file app/default.yaml: yaml parser:"},
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			dir := writeTree(t, tc.files)
+			if tc.symlink {
+				dir = symlinkTo(t, dir)
+			}
+			os.Clearenv()
+			err := os.Setenv("D2C_DIRECTORY", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			err = runValidate()
+			if tc.expect == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected validation to fail")
+			}
+			for _, expect := range tc.expect {
+				if !strings.Contains(err.Error(), expect) {
+					t.Errorf("expected %q in:\n%s", expect, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUntypedDefault(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"sub/default":  "blob",
+		"sub/app.yaml": "a: b\n",
+		"sub/file":     "x",
+	})
+	os.Clearenv()
+	err := os.Setenv("D2C_DIRECTORY", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	// A default file without a type adds no keys to the files below it
+	kvs := kv.NewList()
+	report, err := loadKeyValuesFromDisk(kvs, regexp.MustCompile(`a^`), regexp.MustCompile(`a^`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = report.check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "dir2consul/sub/app/a : b\ndir2consul/sub/file : x\n"
+	if string(kvs.Serialize()) != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, kvs.Serialize())
+	}
+}
+
+func TestKeyProblem(t *testing.T) {
+	for key, expect := range map[string]string{
+		"dir2consul/app/port":   "",
+		"dir2consul/app name/x": "",
+		"/dir2consul/app":       "starts with /",
+		"dir2consul/app/":       "ends with /",
+		"dir2consul//app":       "has an empty path segment",
+		"dir2consul/../app":     "has a relative path segment",
+		"dir2consul/app\x00":    "has a control character",
+		"dir2consul/\xff":       "not valid UTF-8",
+	} {
+		actual, kind := keyProblem(key)
+		if actual != expect {
+			t.Errorf("keyProblem(%q): expected %q, got %q", key, expect, actual)
+		}
+		// Only keys Consul can't take as written stop every sync
+		if invalid := expect == "not valid UTF-8"; invalid != (kind == problemInvalid) {
+			t.Errorf("keyProblem(%q): expected invalid %t, got kind %d", key, invalid, kind)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	cases := []struct {
+		strict string
+		expect string
+		txns   int
+	}{
+		{"false", "", 1},
+		{"true", "bad.yaml: yaml parser:", 0},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_strict_%s", i, tc.strict), func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"bad.yaml": "a: b: c\n", "good.yaml": "a: changed\n"})
+			os.Clearenv()
+			err := os.Setenv("D2C_DIRECTORY", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_STRICT", tc.strict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			fake, client := newFakeConsul(t, map[string]string{"dir2consul/bad/a": "b", "dir2consul/good/a": "b"})
+			err = runSync(client)
+			if tc.expect == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.expect != "" && (err == nil || !strings.Contains(err.Error(), tc.expect)) {
+				t.Fatalf("expected an error containing %q, got %v", tc.expect, err)
+			}
+			if fake.txns != tc.txns {
+				t.Errorf("expected %d transactions, got %d", tc.txns, fake.txns)
+			}
+		})
+	}
+}
+
+func TestSuspectKey(t *testing.T) {
+	cases := []struct {
+		strict string
+		expect string
+		txns   int
+	}{
+		{"false", "", 1},
+		{"true", `invalid key "dir2consul/app/urls/http://x": has an empty path segment`, 0},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_strict_%s", i, tc.strict), func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"app.yaml": "urls:\n  \"http://x\": up\n"})
+			os.Clearenv()
+			for k, v := range map[string]string{"D2C_DIRECTORY": dir, "D2C_STRICT": tc.strict} {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			// The key is written as it always was, unless strict mode stops the sync
+			fake, client := newFakeConsul(t, nil)
+			err := runSync(client)
+			if tc.expect == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.expect != "" && (err == nil || !strings.Contains(err.Error(), tc.expect)) {
+				t.Fatalf("expected an error containing %q, got %v", tc.expect, err)
+			}
+			if fake.txns != tc.txns {
+				t.Errorf("expected %d transactions, got %d", tc.txns, fake.txns)
+			}
+			if tc.expect == "" && fake.values()["dir2consul/app/urls/http://x"] != "up" {
+				t.Errorf("expected dir2consul/app/urls/http://x to be written, got %v", fake.values())
+			}
+		})
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	files := map[string]string{
+		"app.yaml":      "port: 8080\ndb:\n  host: yaml\n",
+		"app.json":      `{"port": "9090"}`,
+		"app/db/host":   "blob",
+		"motd":          "from blob",
+		"motd.txt":      "from txt",
+		"other.yaml":    "a: b\n",
+		"nested/x.json": `{"y": "json"}`,
+		"nested/x/y":    "blob",
+	}
+	cases := []struct {
+		policy     string
+		precedence string
+		expect     []string
+		err        []string
+	}{
+		{
+			policy: "error",
+			err: []string{
+				"app.yaml: key dir2consul/app/port is also loaded from app.json",
+				"app.yaml: key dir2consul/app/db/host is also loaded from app/db/host",
+				"motd.txt: key dir2consul/motd is also loaded from motd",
+			},
+		},
+		{
+			// The last file in walk order wins
+			policy: "warn",
+			expect: []string{"dir2consul/app/port : 8080", "dir2consul/app/db/host : yaml", "dir2consul/motd : from txt", "dir2consul/nested/x/y : json"},
+		},
+		{
+			// Listed extensions beat the rest, then the path that sorts first wins
+			policy: "precedence",
+			expect: []string{"dir2consul/app/port : 8080", "dir2consul/app/db/host : yaml", "dir2consul/motd : from blob", "dir2consul/nested/x/y : json"},
+		},
+		{
+			// Among unlisted extensions the deeper file wins
+			policy:     "precedence",
+			precedence: "json,txt",
+			expect:     []string{"dir2consul/app/port : 9090", "dir2consul/app/db/host : blob", "dir2consul/motd : from txt", "dir2consul/nested/x/y : json"},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.policy), func(t *testing.T) {
+			dir := writeTree(t, files)
+			os.Clearenv()
+			for k, v := range map[string]string{"D2C_DIRECTORY": dir, "D2C_ON_COLLISION": tc.policy, "D2C_COLLISION_PRECEDENCE": tc.precedence} {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			var rendered bytes.Buffer
+			err := runRender(&rendered)
+			if tc.err != nil {
+				if err == nil {
+					t.Fatal("expected collisions to stop the render")
+				}
+				for _, expect := range tc.err {
+					if !strings.Contains(err.Error(), expect) {
+						t.Errorf("expected %q in:\n%s", expect, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expect := range tc.expect {
+				if !strings.Contains(rendered.String(), expect+"\n") {
+					t.Errorf("expected %q in:\n%s", expect, rendered.String())
+				}
+			}
+
+			// Collisions settled by precedence aren't problems
+			err = runValidate()
+			if tc.policy == "precedence" && err != nil {
+				t.Error(err)
+			}
+			if tc.policy == "warn" && err == nil {
+				t.Error("expected validate to report the collisions")
+			}
+		})
+	}
+}
+
+func TestRollup(t *testing.T) {
+	cases := []struct {
+		name   string
+		files  map[string]string
+		regex  string
+		expect string
+		err    string
+	}{
+		{
+			name: "marker",
+			files: map[string]string{
+				"default.yaml":             "region: us\n",
+				"flags/.dir2consul-rollup": "",
+				"flags/checkout":           "on",
+				"flags/search.yaml":        "enabled: \"true\"\nlimit: 10\n",
+				"other.yaml":               "key: value\n",
+			},
+			// Defaults below a file loaded whole are left out of the object
+			expect: "dir2consul/flags : {\"checkout\":\"on\",\"search\":{\"enabled\":\"true\",\"limit\":\"10\",\"region\":\"us\"}}\n" +
+				"dir2consul/other/key : value\n" +
+				"dir2consul/other/region : us\n",
+		},
+		{
+			name: "regex",
+			files: map[string]string{
+				"flags/checkout":       "on",
+				"flags/beta/search":    "off",
+				"flags/beta/.hidden":   "skipped",
+				"teams/flags/checkout": "off",
+			},
+			regex: "(^|/)flags$",
+			expect: "dir2consul/flags : {\"beta\":{\"search\":\"off\"},\"checkout\":\"on\"}\n" +
+				"dir2consul/teams/flags : {\"checkout\":\"off\"}\n",
+		},
+		{
+			name: "empty",
+			files: map[string]string{
+				"flags/.dir2consul-rollup": "",
+			},
+			expect: "dir2consul/flags : {}\n",
+		},
+		{
+			name: "conflict",
+			files: map[string]string{
+				"flags/.dir2consul-rollup": "",
+				"flags/search":             "on",
+				"flags/search.yaml":        "limit: 10\n",
+			},
+			err: "flags: can't roll up into dir2consul/flags: search has a value and keys below it",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			dir := writeTree(t, tc.files)
+			os.Clearenv()
+			for k, v := range map[string]string{"D2C_DIRECTORY": dir, "D2C_ROLLUP_REGEX": tc.regex} {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			var rendered bytes.Buffer
+			err := runRender(&rendered)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rendered.String() != tc.expect {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expect, rendered.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// withLock runs fn while holding a Consul lock on LOCK_KEY, so concurrent runs
+// against the same prefix can't interleave. It waits up to LOCK_WAIT for the
+// lock. Without a LOCK_KEY, or on a dry run, fn runs without a lock.
+func withLock(consulClient *api.Client, fn func() error) error {
+	key := viper.GetString("LOCK_KEY")
+	if key == "" || viper.GetBool("DRYRUN") {
+		return fn()
+	}
+
+	hostname, _ := os.Hostname()
+	lock, err := consulClient.LockOpts(&api.LockOptions{
+		Key:          key,
+		Value:        []byte("dir2consul on " + hostname),
+		SessionName:  "dir2consul",
+		LockWaitTime: viper.GetDuration("LOCK_WAIT"),
+		LockTryOnce:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting up lock %s: %v", key, err)
+	}
+
+	if viper.GetBool("VERBOSE") {
+		log.Printf("Acquiring lock %s...", key)
+	}
+	lostCh, err := lock.Lock(nil)
+	if err != nil {
+		return fmt.Errorf("Error acquiring lock %s: %v", key, err)
+	}
+	if lostCh == nil {
+		return lockHeldError(consulClient, key)
+	}
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			log.Printf("Error releasing lock %s: %s", key, err)
+		}
+	}()
+
+	err = fn()
+
+	select {
+	case <-lostCh:
+		if err == nil {
+			err = fmt.Errorf("Lost lock %s while syncing; another run may have changed Consul at the same time", key)
+		}
+	default:
+	}
+	return err
+}
+
+// lockHeldError describes who holds the lock on key
+func lockHeldError(consulClient *api.Client, key string) error {
+	wait := viper.GetDuration("LOCK_WAIT")
+	pair, _, err := consulClient.KV().Get(key, nil)
+	if err != nil || pair == nil || pair.Session == "" {
+		return fmt.Errorf("Lock %s is held by another run; gave up after waiting %s", key, wait)
+	}
+	return fmt.Errorf("Lock %s is held by session %s (%s); gave up after waiting %s", key, pair.Session, pair.Value, wait)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWithLock(t *testing.T) {
+	os.Clearenv()
+	err := os.Setenv("D2C_LOCK_KEY", "locks/dir2consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, nil)
+
+	ran := false
+	err = withLock(client, func() error {
+		ran = true
+		if fake.session("locks/dir2consul") == "" {
+			t.Error("lock should be held while the sync runs")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Error("sync did not run")
+	}
+	if fake.session("locks/dir2consul") != "" {
+		t.Error("lock should be released after the sync")
+	}
+
+	expect := errors.New("sync failed")
+	err = withLock(client, func() error { return expect })
+	if err != expect {
+		t.Errorf("expected the sync error, got %v", err)
+	}
+}
+
+func TestWithLockHeld(t *testing.T) {
+	os.Clearenv()
+	err := os.Setenv("D2C_LOCK_KEY", "locks/dir2consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_LOCK_WAIT", "100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, nil)
+	fake.lockedBy("locks/dir2consul", "other-session", "dir2consul on other-host")
+
+	err = withLock(client, func() error {
+		t.Error("sync must not run without the lock")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected an error while the lock is held")
+	}
+	if !strings.Contains(err.Error(), "other-session") || !strings.Contains(err.Error(), "other-host") {
+		t.Errorf("error does not say who holds the lock: %s", err)
+	}
+}
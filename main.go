@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -20,13 +19,43 @@ import (
 func main() {
 
 	setupEnvironment()
-	fmt.Println(startupMessage())
 
-	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
-	if err != nil {
-		log.Fatal(err)
+	// The first argument picks the command. Without one we sync.
+	command := "sync"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
 	}
 
+	// Validating, rendering and explaining only read files. Rendering and
+	// explaining write their output to stdout, so the startup message goes to stderr.
+	switch command {
+	case "validate":
+		fmt.Println(startupMessage())
+		err := runValidate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "render":
+		_, _ = fmt.Fprintln(os.Stderr, startupMessage())
+		err := runRender(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "explain":
+		_, _ = fmt.Fprintln(os.Stderr, startupMessage())
+		if len(os.Args) != 3 {
+			log.Fatal("Usage: dir2consul explain <key>")
+		}
+		err := runExplain(os.Stdout, os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fmt.Println(startupMessage())
+
 	// Establish a Consul client
 	// Lots of configuration is encapsulated here.
 	// Reference https://github.com/hashicorp/consul/tree/master/api
@@ -35,45 +64,253 @@ func main() {
 		log.Fatal("Error establishing Consul client:", err)
 	}
 
+	switch command {
+	case "sync":
+		err = runSync(consulClient)
+	case "watch":
+		err = runWatch(consulClient)
+	case "export":
+		err = runExport(consulClient)
+	case "restore":
+		err = withLock(consulClient, func() error {
+			return restoreBackup(consulClient)
+		})
+	default:
+		err = fmt.Errorf("Unknown command %q: use sync, watch, validate, render, explain, export or restore", command)
+	}
+	if err == errDrift {
+		os.Exit(exitDrift)
+	}
+	if failed, ok := err.(*txnFailedError); ok {
+		failed.logSummary()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+}
+
+// exitDrift is the exit code for a drift check that finds differences.
+// Errors exit with 1 through log.Fatal.
+const exitDrift = 2
+
+// errDrift is returned by a drift check that finds differences
+var errDrift = errors.New("drift detected")
+
+// runSync loads the file data and mirrors it to Consul, or only compares the two when DRIFT_CHECK is set
+func runSync(consulClient *api.Client) error {
+	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
+	if err != nil {
+		return err
+	}
+
 	// Get KVs from Files
 	fileKeyValues := kv.NewList()
-	err = loadKeyValuesFromDisk(fileKeyValues, dirIgnoreRe, fileIgnoreRe)
+	report, err := loadKeyValuesFromDisk(fileKeyValues, dirIgnoreRe, fileIgnoreRe)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	// Stop before touching Consul, since skipped files would have their keys deleted
+	err = report.check(viper.GetBool("STRICT"))
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool("DRIFT_CHECK") {
+		drift, err := checkDrift(fileKeyValues, consulClient)
+		if err != nil {
+			return err
+		}
+		if drift {
+			log.Printf("Drift detected between %s and Consul prefix %s", viper.GetString("DIRECTORY"), viper.GetString("CONSUL_KEY_PREFIX"))
+			return errDrift
+		}
+		return nil
 	}
 
+	return withLock(consulClient, func() error {
+		_, err := syncConsul(fileKeyValues, nil, consulClient)
+		return err
+	})
+}
+
+// checkDrift compares the file data to Consul without writing anything and
+// reports whether they differ. The plan is printed when they do.
+func checkDrift(fileKeyValues *kv.List, consulClient *api.Client) (bool, error) {
+	p, err := buildPlan(fileKeyValues, consulClient)
+	if err != nil {
+		return false, err
+	}
+
+	if p.hasChanges() || viper.GetBool("VERBOSE") {
+		err = writePlan(p)
+		if err != nil {
+			return false, err
+		}
+	}
+	return p.hasChanges(), nil
+}
+
+// syncConsul makes the Consul data under CONSUL_KEY_PREFIX match the file data.
+// Every write is a check-and-set against the index read when listing Consul, so
+// keys edited by someone else in the meantime are reported as conflicts. When
+// ON_CONFLICT is "replan" the Consul data is listed again and the sync retried.
+// When scope isn't nil, keys outside it are left alone. It returns the plan it carried out.
+func syncConsul(fileKeyValues *kv.List, scope keyScope, consulClient *api.Client) (*plan, error) {
+	onConflict := viper.GetString("ON_CONFLICT")
+	if onConflict != "abort" && onConflict != "replan" {
+		return nil, fmt.Errorf("Unknown D2C_ON_CONFLICT value %q: use abort or replan", onConflict)
+	}
+
+	for attempt := 1; ; attempt++ {
+		p, err := buildPlan(fileKeyValues, consulClient)
+		if err != nil {
+			return nil, err
+		}
+		if scope != nil {
+			p.skipOutside(scope)
+		}
+
+		if viper.GetBool("DRYRUN") || viper.GetBool("VERBOSE") {
+			err = writePlan(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Stop before anything changes if the plan deletes suspiciously many keys
+		err = p.checkDeleteLimits()
+		if err != nil {
+			return nil, err
+		}
+
+		if viper.GetBool("DRYRUN") {
+			return p, nil
+		}
+
+		// Save what Consul held before the first change, so it can be restored
+		if attempt == 1 && p.hasChanges() {
+			err = writeBackup(p.consulPairs, consulClient)
+			if err != nil {
+				return nil, fmt.Errorf("Error backing up %s, nothing was changed: %v", p.Prefix, err)
+			}
+		}
+
+		// Apply the whole change set through Consul transactions
+		err = applyTxnOps(p.txnOps(), consulClient)
+		if err == nil {
+			return p, nil
+		}
+		conflict, ok := err.(*txnConflictError)
+		if !ok {
+			return nil, err
+		}
+		for _, c := range conflict.conflicts {
+			log.Printf("Conflict on key %s: %s", c.key, c.reason)
+		}
+		if onConflict == "abort" || attempt >= viper.GetInt("REPLAN_ATTEMPTS") {
+			return nil, err
+		}
+		log.Printf("Re-planning after %d conflicting keys (attempt %d of %d)", len(conflict.conflicts), attempt+1, viper.GetInt("REPLAN_ATTEMPTS"))
+	}
+}
+
+// buildPlan lists the Consul data and plans to add or update data in Consul when it doesn't
+// match the file data, and delete data from Consul that doesn't exist in the file data.
+// Protected keys, the lock key, and keys owned by someone else when OWNER_FLAGS is set, are skipped.
+func buildPlan(fileKeyValues *kv.List, consulClient *api.Client) (*plan, error) {
 	// Get KVs from Consul
+	consulKeyValues, consulPairs, err := loadKeyValuesFromConsul(consulClient)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPlan(fileKeyValues, consulKeyValues, consulPairs)
+	err = p.skipUnmanaged()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// loadKeyValuesFromConsul lists CONSUL_KEY_PREFIX and returns the values along with the
+// listed pairs, which carry the ModifyIndex and Flags of each key. Only keys below the
+// prefix are listed, so a neighbour such as dir2consul-backup beside dir2consul isn't.
+func loadKeyValuesFromConsul(consulClient *api.Client) (*kv.List, map[string]*api.KVPair, error) {
 	consulKeyValues := kv.NewList()
-	consulKVPairs, _, err := consulClient.KV().List(viper.GetString("CONSUL_KEY_PREFIX"), nil)
+	consulPairs := make(map[string]*api.KVPair)
+	var consulKVPairs api.KVPairs
+	err := retry("Listing "+viper.GetString("CONSUL_KEY_PREFIX"), func() error {
+		var err error
+		consulKVPairs, _, err = consulClient.KV().List(viper.GetString("CONSUL_KEY_PREFIX")+"/", nil)
+		return err
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 	for _, consulKVPair := range consulKVPairs {
 		_, _, err = consulKeyValues.Set(consulKVPair.Key, consulKVPair.Value)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
+		consulPairs[consulKVPair.Key] = consulKVPair
 	}
+	return consulKeyValues, consulPairs, nil
+}
 
-	// Add or update data in Consul when it doesn't match the file data
-	addOrUpdateConsulData(fileKeyValues, consulKeyValues, consulClient)
-
-	// Delete data from Consul that doesn't exist in the file data
-	deleteExtraConsulData(fileKeyValues, consulKeyValues, consulClient)
-
+// envDefaults holds the default value of each D2C_ environment variable
+var envDefaults = map[string]string{
+	"ADOPT":                  "false",
+	"BACKUP_FILE":            "",
+	"BACKUP_PREFIX":          "",
+	"COLLISION_PRECEDENCE":   "yaml,yml,json,toml,hcl,ini,properties,env",
+	"CONSUL_KEY_PREFIX":      "dir2consul",
+	"DEFAULT_CONFIG_TYPE":    "",
+	"DIRECTORY":              "local/repo",
+	"DOCUMENT_FORMAT":        "json",
+	"DOCUMENT_REGEX":         "a^",
+	"DRIFT_CHECK":            "false",
+	"DRYRUN":                 "false",
+	"EXPORT_FORMAT":          "blob",
+	"FORCE_DELETE":           "false",
+	"IGNORE_DIR_REGEX":       `a^`,
+	"IGNORE_FILE_REGEX":      `README.md`,
+	"LOCK_KEY":               "",
+	"LOCK_WAIT":              "15s",
+	"LOWERCASE_KEYS":         "false",
+	"MAX_DELETES":            "-1",
+	"MAX_DELETE_PERCENT":     "100",
+	"METRICS_SINK":           "",
+	"ON_COLLISION":           "warn",
+	"ON_CONFLICT":            "abort",
+	"OWNER_FLAGS":            "0",
+	"PLAN_FILE":              "",
+	"PLAN_FORMAT":            "text",
+	"PROTECTED_KEYS":         "",
+	"PROTECTED_KEY_REGEX":    `a^`,
+	"REDACT_ENTROPY":         "0",
+	"REDACT_KEYS":            "",
+	"REDACT_KEY_REGEX":       `(?i)(password|passwd|secret|token|credential|private_?key|api_?key)`,
+	"REDACT_VALUE_REGEX":     `-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+	"RENDER_FORMAT":          "text",
+	"RENDER_SOURCES":         "false",
+	"REPLAN_ATTEMPTS":        "3",
+	"REVERT_INTERVAL":        "10s",
+	"RETRY_ATTEMPTS":         "5",
+	"RETRY_MAX_WAIT":         "10s",
+	"RETRY_MIN_WAIT":         "250ms",
+	"ROLLUP_MARKER":          ".dir2consul-rollup",
+	"ROLLUP_REGEX":           "a^",
+	"SENSITIVE_ENV_PATTERNS": "TOKEN,SECRET,PASSWORD,PASSWD,KEY,CREDENTIAL,AUTH,PRIVATE,CERT",
+	"SHOW_ENVIRONMENT":       "false",
+	"STRICT":                 "false",
+	"WATCH_CONSUL":           "false",
+	"WATCH_DEBOUNCE":         "2s",
+	"VALUE_ENCODING":         "string",
+	"VERBOSE":                "false",
 }
 
 func setupEnvironment() {
-	envDefaults := map[string]string{
-		"CONSUL_KEY_PREFIX":   "dir2consul",
-		"DEFAULT_CONFIG_TYPE": "",
-		"DIRECTORY":           "local/repo",
-		"DRYRUN":              "false",
-		"IGNORE_DIR_REGEX":    `a^`,
-		"IGNORE_FILE_REGEX":   `README.md`,
-		"VERBOSE":             "false",
-	}
-
 	viper.SetEnvPrefix("D2C")
 
 	for key, val := range envDefaults {
@@ -88,19 +325,62 @@ func setupEnvironment() {
 			log.Fatalf("Error setting up environment: %s", err)
 		}
 	}
+
+	err := setupRedaction()
+	if err != nil {
+		log.Fatalf("Error setting up environment: %s", err)
+	}
 }
 
 func startupMessage() string {
 	banner := "\n------------\n dir2consul \n------------\n"
 
-	config := "Configuration" + "\n\tD2C_CONSUL_KEY_PREFIX: " + viper.GetString("CONSUL_KEY_PREFIX") + "\n\tD2C_DEFAULT_CONFIG_TYPE: " + viper.GetString("DEFAULT_CONFIG_TYPE") + "\n\tD2C_DIRECTORY: " + viper.GetString("DIRECTORY") + "\n\tD2C_DRYRUN: " + viper.GetString("DRYRUN") + "\n\tD2C_IGNORE_DIR_REGEX: " + viper.GetString("IGNORE_DIR_REGEX") + "\n\tD2C_IGNORE_FILE_REGEX: " + viper.GetString("IGNORE_FILE_REGEX") + "\n\tD2C_VERBOSE: " + viper.GetString("VERBOSE")
+	keys := make([]string, 0, len(envDefaults))
+	for key := range envDefaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	config := "Configuration"
+	for _, key := range keys {
+		config += "\n\tD2C_" + key + ": " + viper.GetString(key)
+	}
 
-	env := os.Environ()
+	if !viper.GetBool("SHOW_ENVIRONMENT") {
+		return banner + config
+	}
+
+	env := redactEnvironment(os.Environ(), viper.GetString("SENSITIVE_ENV_PATTERNS"))
 	sort.Strings(env)
 	environment := fmt.Sprintf("\nEnvironment\n\t%s", strings.Join(env, "\n\t"))
 	return banner + config + environment
 }
 
+// redactEnvironment replaces the values of variables whose names contain any
+// of the comma separated patterns, ignoring case, with "<redacted>"
+func redactEnvironment(env []string, patterns string) []string {
+	var sensitive []string
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			sensitive = append(sensitive, strings.ToUpper(pattern))
+		}
+	}
+
+	redacted := make([]string, 0, len(env))
+	for _, variable := range env {
+		name := strings.SplitN(variable, "=", 2)[0]
+		for _, pattern := range sensitive {
+			if strings.Contains(strings.ToUpper(name), pattern) {
+				variable = name + "=<redacted>"
+				break
+			}
+		}
+		redacted = append(redacted, variable)
+	}
+	return redacted
+}
+
 func compileRegexps(dirPcre string, filePcre string) (*regexp.Regexp, *regexp.Regexp, error) {
 	var err error
 	var dirRe, fileRe *regexp.Regexp
@@ -118,21 +398,54 @@ func compileRegexps(dirPcre string, filePcre string) (*regexp.Regexp, *regexp.Re
 	return dirRe, fileRe, nil
 }
 
-// loadKeyValuesFromDisk walks the file system and loads file contents into a kv.List
-func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe *regexp.Regexp) error {
+// loadKeyValuesFromDisk walks the file system and loads file contents into a kv.List.
+// Files with problems are skipped and the problems returned in the report.
+// Failing to change directory is an error rather than fatal, so watch can retry.
+func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe *regexp.Regexp) (_ *loadReport, err error) {
+	switch onCollision := viper.GetString("ON_COLLISION"); onCollision {
+	case "error", "warn", "precedence":
+	default:
+		return nil, fmt.Errorf("Unknown D2C_ON_COLLISION value %q: use error, warn or precedence", onCollision)
+	}
+	switch encoding := viper.GetString("VALUE_ENCODING"); encoding {
+	case "string", "json", "indexed":
+	default:
+		return nil, fmt.Errorf("Unknown D2C_VALUE_ENCODING value %q: use string, json or indexed", encoding)
+	}
+	switch format := viper.GetString("DOCUMENT_FORMAT"); format {
+	case "json", "source":
+	default:
+		return nil, fmt.Errorf("Unknown D2C_DOCUMENT_FORMAT value %q: use json or source", format)
+	}
+	documentRe, err := regexp.Compile(viper.GetString("DOCUMENT_REGEX"))
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling D2C_DOCUMENT_REGEX: %v", err)
+	}
+	rollupRe, err := regexp.Compile(viper.GetString("ROLLUP_REGEX"))
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling D2C_ROLLUP_REGEX: %v", err)
+	}
+
 	// Change directory to where the files are located
 
-	// Store where we are currently
+	// Store where we are currently, and go back there when we're done so
+	// relative paths in the rest of the configuration still work
 	curWD, err := os.Getwd()
 	if err != nil {
-		log.Fatal("Couldn't get current working directory!")
+		return nil, fmt.Errorf("Couldn't get current working directory: %v", err)
 	}
+	defer func() {
+		chdirErr := os.Chdir(curWD)
+		if chdirErr != nil && err == nil {
+			err = fmt.Errorf("Couldn't change directory back to %s: %v", curWD, chdirErr)
+		}
+	}()
 	// Check if the DIRECTORY environment variable is an absolute path...
 	if filepath.IsAbs(viper.GetString("DIRECTORY")) {
 		// Our root directory is an absolute path and we can just move along...
 		err := os.Chdir(viper.GetString("DIRECTORY"))
 		if err != nil {
-			log.Fatal("Couldn't change directory to:", viper.GetString("DIRECTORY"))
+			return nil, fmt.Errorf("Couldn't change directory to %s: %v", viper.GetString("DIRECTORY"), err)
 		}
 	} else {
 		// Our root directory is NOT an absolute path, so do some trickery here...
@@ -146,14 +459,26 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 			// so try and move there...
 			err := os.Chdir(viper.GetString("DIRECTORY"))
 			if err != nil {
-				log.Fatal("Couldn't change directory to:", viper.GetString("DIRECTORY"))
+				return nil, fmt.Errorf("Couldn't change directory to %s: %v", viper.GetString("DIRECTORY"), err)
 			}
 		}
 	}
 	// We should now be where we want to be, hopefully...
 
 	// Walk the filesystem
-	return filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+	report := newLoadReport()
+
+	// Files, default files and the root they are reported relative to all use
+	// the resolved directory, so they agree when DIRECTORY is a symlink
+	root, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -173,8 +498,15 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 			return filepath.SkipDir
 		}
 
-		// Skip directories, non-regular files, and dot files
-		if info.Mode().IsDir() || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+		// Note directories to roll up into one value, marked by a file or matching ROLLUP_REGEX
+		if info.Mode().IsDir() {
+			if _, err := os.Stat(filepath.Join(path, viper.GetString("ROLLUP_MARKER"))); err == nil || rollupRe.MatchString(filepath.ToSlash(path)) {
+				report.addRollup(path)
+			}
+		}
+
+		// Skip directories, non-regular files, and dot files other than .env
+		if info.Mode().IsDir() || !info.Mode().IsRegular() || (strings.HasPrefix(info.Name(), ".") && info.Name() != ".env") {
 			return nil
 		}
 
@@ -198,6 +530,12 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 
 		elemKey := strings.TrimSuffix(path, filepath.Ext(path))
 
+		// The keys in a file go below its key, except that a .env file holds its directory's keys
+		keyPrefix := viper.GetString("CONSUL_KEY_PREFIX") + "/" + elemKey
+		if info.Name() == ".env" {
+			keyPrefix = strings.TrimSuffix(keyPrefix, "/")
+		}
+
 		filetype := strings.TrimPrefix((strings.ToLower(filepath.Ext(path))), ".")
 
 		if viper.GetBool("VERBOSE") {
@@ -209,46 +547,16 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 		// The path of the file we have just hit.
 		pathPath := filepath.Dir(path)
 
-		// The path we started at
-		pathRoot := viper.GetString("DIRECTORY")
-
 		// Call findDefaults and generate a list of all defaults between the "root" and where we are now,
 		// including default files at the same level of the directory hierarchy as we currently are.
-		defaultList, err := findDefaults(pathPath, pathRoot)
+		defaultList, err := findDefaults(pathPath, root)
 		if err != nil {
-			log.Printf("Error processing path %s: %s", pathRoot+"/"+pathPath, err)
-			return err
+			report.add(path, problemInvalid, "%v", err)
+			return nil
 		}
 
-		// This is the "full" path between where we started -- or the absolute root of the filesystem -- and
-		// where we are now
-		comboPath := pathRoot + "/" + path
-
-		// This should be an absolute path to the file we're at right now.
-		var pathFull string
-
-		if filepath.IsAbs(comboPath) {
-			// if the comboPath is an absolute path, set pathFull to it
-			pathFull = comboPath
-		} else {
-			// if the comboPath is relative (ie, if the DIRECTORY environment variable is relative)
-			// construct an absolute path and assign it to pathFull
-			curWD, err := os.Getwd()
-			if err != nil {
-				return err
-			}
-
-			if strings.HasSuffix(curWD, pathRoot) {
-				// We already have the pathRoot in our WD
-				pathFull = curWD + "/" + path
-			} else {
-				err = nil
-				pathFull, err = filepath.Abs(pathPath + "/" + path)
-				if err != nil {
-					return err
-				}
-			}
-		}
+		// This is the absolute path to the file we're at right now.
+		pathFull := filepath.Join(root, path)
 
 		// Construct a list of files we care about. Start with the list of defaults we found...
 		var filesToParse []string
@@ -257,7 +565,7 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 
 		// Check the type of the file we're parsing (ie, not the defaults)
 		switch filetype {
-		case "hcl", "ini", "json", "properties", "toml", "yaml", "yml":
+		case "env", "hcl", "ini", "json", "properties", "toml", "yaml", "yml":
 			// If we understand the filetype, let Viper parse it...
 			if !strings.HasPrefix(filepath.Base(path), "default") {
 				filesToParse = append(filesToParse, pathFull)
@@ -273,22 +581,25 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 			// from the top of the hierarchy down to the file we are looking at, then the file
 			// we're looking at.  The results of all the properties in all those files should come
 			// to us in the viper object 'v'.
-			v, err := mergeConfiguration(filesToParse)
+			v, sources, err := mergeWithSources(filesToParse)
 			if err != nil {
-				if viper.GetBool("VERBOSE") {
-					log.Printf("Error merging configs! %s", err)
-				}
+				report.addLoadError(root, path, err)
 				return nil
 			}
 
+			// Store the whole document under one key when asked to
+			if documentRe.MatchString(filepath.ToSlash(path)) {
+				return report.setDocument(kv, root, path, keyPrefix, v, filetype)
+			}
+
 			// iterate over keys within the merged viper object, and set them in the 'kv' store
 			for _, key := range v.AllKeys() {
 				if viper.GetBool("VERBOSE") {
-					log.Printf("%s=%s", elemKey+"/"+key, v.GetString(key))
+					log.Printf("%s=%s", elemKey+"/"+key, redact(elemKey+"/"+key, []byte(v.GetString(key))))
 				}
-				_, _, err = kv.Set(viper.GetString("CONSUL_KEY_PREFIX")+"/"+elemKey+"/"+key, []byte(v.GetString(key)))
+				err = report.set(kv, path, keyPrefix+"/"+key, []byte(v.GetString(key)), relativeSources(root, sources[key]))
 				if err != nil {
-					log.Fatal(err)
+					return err
 				}
 			}
 		default:
@@ -322,24 +633,26 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 			// Load & merge all the configuration files, in order
 			// NOTE:  If we don't have a default type, this list will only be the defaults files
 			// NOTE:  Not our file of interest...
-			v, err := mergeConfiguration(filesToParse)
+			v, sources, err := mergeWithSources(filesToParse)
 			if err != nil {
-				if viper.GetBool("VERBOSE") {
-					log.Printf("Error merging configs! %s", err)
-				}
+				report.addLoadError(root, path, err)
 				return nil
 			}
 
+			if defaultType != "" && documentRe.MatchString(filepath.ToSlash(path)) {
+				return report.setDocument(kv, root, path, viper.GetString("CONSUL_KEY_PREFIX")+"/"+elemKey, v, defaultType)
+			}
+
 			// iterate over keys within the merged viper configuration object
 			// NOTE:  If we don't have a default type set in the environment, this will only be a merged
 			// NOTE:  property file of all the defaults
 			for _, key := range v.AllKeys() {
 				if viper.GetBool("VERBOSE") {
-					log.Printf("%s=%s", elemKey+"/"+key, v.GetString(key))
+					log.Printf("%s=%s", elemKey+"/"+key, redact(elemKey+"/"+key, []byte(v.GetString(key))))
 				}
-				_, _, err = kv.Set(viper.GetString("CONSUL_KEY_PREFIX")+"/"+elemKey+"/"+key, []byte(v.GetString(key)))
+				err = report.set(kv, path, keyPrefix+"/"+key, []byte(v.GetString(key)), relativeSources(root, sources[key]))
 				if err != nil {
-					log.Fatal(err)
+					return err
 				}
 			}
 
@@ -347,10 +660,8 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 			// kv set automagically as a single blob.
 			if defaultType == "" {
 				// Now that the default files are absorbed, absorb this whole file as a single property.
-				if info.Size() > 512000 {
-					if viper.GetBool("VERBOSE") {
-						log.Printf("Skipping %s: size exceeds Consul's 512KB limit", elemKey)
-					}
+				if info.Size() > maxValueSize {
+					report.add(path, problemLoad, "file is %d bytes, over the %d byte limit", info.Size(), maxValueSize)
 					return nil
 				}
 
@@ -359,57 +670,21 @@ func loadKeyValuesFromDisk(kv *kv.List, dirIgnoreRe *regexp.Regexp, fileIgnoreRe
 					return err
 				}
 				if viper.GetBool("VERBOSE") {
-					log.Printf("%s=%s", elemKey, []byte(elemVal))
+					log.Printf("%s=%s", elemKey, redact(elemKey, elemVal))
 				}
-				_, _, err = kv.Set(viper.GetString("CONSUL_KEY_PREFIX")+"/"+elemKey, elemVal)
+				err = report.set(kv, path, viper.GetString("CONSUL_KEY_PREFIX")+"/"+elemKey, elemVal, []keySource{{File: path, Value: string(elemVal)}})
 				if err != nil {
-					log.Fatal(err)
+					return err
 				}
 			}
 		}
 
 		return nil
 	})
-}
-
-func addOrUpdateConsulData(fileKeyValues *kv.List, consulKeyValues *kv.List, consulClient *api.Client) {
-	// Add or update data in Consul when it doesn't match the file data
-	for _, key := range fileKeyValues.Keys() {
-		_, fb, _ := fileKeyValues.Get(key, nil)
-		_, cb, _ := consulKeyValues.Get(key, nil)
-		if bytes.Compare(fb, cb) != 0 {
-			if viper.GetBool("DRYRUN") {
-				continue
-			}
-			if viper.GetBool("VERBOSE") {
-				log.Printf("SET key: %s value: %s\n", key, string(fb))
-			}
-			p := &api.KVPair{Key: key, Value: fb}
-			_, err := consulClient.KV().Put(p, nil)
-			if err != nil {
-				log.Println("Failed Consul KV Put:", err)
-			}
-		}
-	}
-}
-
-func deleteExtraConsulData(fileKeyValues *kv.List, consulKeyValues *kv.List, consulClient *api.Client) {
-	// Delete data from Consul that doesn't exist in the file data
-	for _, key := range consulKeyValues.Keys() {
-		_, _, err := fileKeyValues.Get(key, nil)
-		if err != nil { // xxx: check for the not exist err
-			if viper.GetBool("DRYRUN") {
-				continue
-			}
-			if viper.GetBool("VERBOSE") {
-				log.Printf("DELETE key: %s\n", key)
-			}
-			_, err := consulClient.KV().Delete(key, nil)
-			if err != nil {
-				log.Println("Failed Consul KV Delete:", err)
-			}
-		}
+	if err == nil {
+		err = report.finishRollups(kv)
 	}
+	return report, err
 }
 
 func findDefaults(path string, rootProvided string) ([]string, error) {
@@ -557,8 +832,16 @@ func findDefaults(path string, rootProvided string) ([]string, error) {
 	return results, nil
 }
 
-func mergeConfiguration(files []string) (config *viper.Viper, err error) {
-	// Take a list of files, return a single Viper configuration object containing
+func mergeConfiguration(files []string) (config *configValues, err error) {
+	config, _, err = mergeWithSources(files)
+	return config, err
+}
+
+// mergeWithSources merges files like mergeConfiguration, and also returns the
+// files that set each key along with the value each one set, in precedence
+// order, so the last one is the value that was kept
+func mergeWithSources(files []string) (*configValues, map[string][]keySource, error) {
+	// Take a list of files, return a single configuration object containing
 	// the properties present in each individual file, in the same order as they are
 	// in the list.
 	//
@@ -567,38 +850,37 @@ func mergeConfiguration(files []string) (config *viper.Viper, err error) {
 	// file in the third element of the array, you would end up with the value from that
 	// third file.  It would override the value in the first.
 
-	// Make a viper object to hold the merged config
-	zfinal := viper.NewWithOptions(viper.KeyDelimiter("/"))
+	// Make an object to hold the merged config
+	zfinal := newConfigValues()
+	sources := make(map[string][]keySource)
 
 	for _, z := range files {
 
-		// For each file in our list, read it into a new viper object
+		// For each file in our list, read it into a new object
 		zv, err := loadFile(z)
 
 		if err != nil {
-			return nil, fmt.Errorf("Fatal error config file %s: %s", z, err)
+			return nil, nil, &parseError{path: z, parser: parserName(z), err: err}
 		}
-
-		zvSettings := zv.AllSettings()
-
-		// Merge in the settings in the newly loaded viper object into our
-		// merged viper object
-		err = zfinal.MergeConfigMap(zvSettings)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to merge configuration! %s", err)
+		for _, key := range zv.AllKeys() {
+			sources[key] = append(sources[key], keySource{File: z, Value: zv.GetString(key)})
 		}
+		zfinal.layers = append(zfinal.layers, configLayer{file: z, tree: zv.tree})
+
+		// Merge the keys in the newly loaded object into our merged object
+		zfinal.merge(zv)
 	}
 
-	return zfinal, nil
+	return zfinal, sources, nil
 }
 
-func loadFile(path string) (*viper.Viper, error) {
-	// If given a file, load it into a viper object
+func loadFile(path string) (*configValues, error) {
+	// If given a file, load it into a configuration object
 
 	// Normally this is straightforward.  We have some special behavior if it's not a "real" property file.
 	// In that case, we load it as a single "blob" (assuming it's small enough to be held as a blob in consul).
 
-	results := viper.NewWithOptions(viper.KeyDelimiter("/"))
+	results := newConfigValues()
 
 	elemKey := strings.TrimSuffix(path, filepath.Ext(path))
 	filetype := strings.TrimPrefix((strings.ToLower(filepath.Ext(path))), ".")
@@ -610,18 +892,15 @@ func loadFile(path string) (*viper.Viper, error) {
 	defaultType := viper.GetString("DEFAULT_CONFIG_TYPE")
 
 	switch filetype {
-	case "hcl", "ini", "json", "properties", "toml", "yaml", "yml":
+	case "env", "hcl", "ini", "json", "properties", "toml", "yaml", "yml":
 		// The file type is well undersood.  Load away.
-		fileDir := filepath.Dir(path)
-		fileFile := filepath.Base(path)
-
-		results.SetConfigName(fileFile)
-		results.AddConfigPath(fileDir)
-		results.SetConfigType(filetype)
-
-		err := results.ReadInConfig()
+		content, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("Fatal error config file %s: %s", path, err)
+			return nil, err
+		}
+		err = results.decode(content, filetype)
+		if err != nil {
+			return nil, err
 		}
 	default:
 		if defaultType == "" {
@@ -651,26 +930,18 @@ func loadFile(path string) (*viper.Viper, error) {
 				return nil, fmt.Errorf("Skipping %s: size exceeds Consul's 512KB limit", elemKey)
 			}
 
-			elemVal, err := ioutil.ReadFile(path)
-			if err != nil {
-				return nil, err
-			}
+			// The walk loads an untyped file whole as a blob, so there are no keys
+			// to merge. An untyped default file adds nothing, as it didn't with viper.
 			if viper.GetBool("VERBOSE") {
-				log.Printf("%s=%s", elemKey, []byte(elemVal))
+				log.Printf("Not merging untyped file %s", path)
 			}
-
-			// Load the value into our viper object
-			results.Set(elemKey, elemVal)
 		} else {
-			// We have a default type.  Load this file using viper, as a file of that type, into our viper object
-			fileDir := filepath.Dir(path)
-			fileFile := filepath.Base(path)
-
-			results.SetConfigName(fileFile)
-			results.AddConfigPath(fileDir)
-			results.SetConfigType(defaultType)
-
-			err := results.ReadInConfig()
+			// We have a default type.  Load this file as a file of that type into our configuration object
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			err = results.decode(content, defaultType)
 			if err != nil {
 				return nil, fmt.Errorf("Fatal error config file %s: %s", path, err)
 			}
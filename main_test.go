@@ -35,34 +35,83 @@ func TestSetupEnvironment(t *testing.T) {
 	if viper.GetString("IGNORE_FILE_REGEX") != "README.md" {
 		t.Error("D2C_IGNORE_FILE_REGEX != README.md")
 	}
+	if viper.GetString("ON_CONFLICT") != "abort" {
+		t.Error("D2C_ON_CONFLICT != abort")
+	}
+	if viper.GetInt("REPLAN_ATTEMPTS") != 3 {
+		t.Error("D2C_REPLAN_ATTEMPTS != 3")
+	}
 	if viper.GetString("VERBOSE") != "false" && !viper.GetBool("VERBOSE") {
 		t.Error("D2C_VERBOSE != false")
 	}
 }
 
 func TestStartupMessage(t *testing.T) {
-	os.Clearenv()
-	err := os.Setenv("TEST", "TestStartupMessage")
-	if err != nil {
-		t.Fatal(err)
-	}
-	setupEnvironment()
-	actual := []byte(startupMessage())
-	auFile := "testdata/TestStartupMessage.golden"
-	if *update {
-		err = ioutil.WriteFile(auFile, actual, 0644)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-	golden, err := ioutil.ReadFile(auFile)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !bytes.Equal(golden, actual) {
-		t.Errorf("failed\nexpected:\n%s\ngot:\n%s", string(golden[:]), string(actual[:]))
+	cases := []struct {
+		name   string
+		env    map[string]string
+		golden string
+	}{
+		{
+			"environment hidden",
+			map[string]string{
+				"TEST":              "TestStartupMessage",
+				"CONSUL_HTTP_TOKEN": "secret-token",
+			},
+			"testdata/TestStartupMessage.golden",
+		},
+		{
+			"environment redacted",
+			map[string]string{
+				"TEST":                  "TestStartupMessage",
+				"CONSUL_HTTP_TOKEN":     "secret-token",
+				"AWS_SECRET_ACCESS_KEY": "secret-key",
+				"DB_Password":           "secret-password",
+				"D2C_SHOW_ENVIRONMENT":  "true",
+			},
+			"testdata/TestStartupMessage_environment.golden",
+		},
+		{
+			"custom patterns",
+			map[string]string{
+				"TEST":                       "TestStartupMessage",
+				"CONSUL_HTTP_ADDR":           "127.0.0.1:8500",
+				"D2C_SHOW_ENVIRONMENT":       "true",
+				"D2C_SENSITIVE_ENV_PATTERNS": "test, addr",
+			},
+			"testdata/TestStartupMessage_patterns.golden",
+		},
 	}
 
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range tc.env {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+			actual := []byte(startupMessage())
+			if *update {
+				err := ioutil.WriteFile(tc.golden, actual, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := ioutil.ReadFile(tc.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(golden, actual) {
+				t.Errorf("failed\nexpected:\n%s\ngot:\n%s", string(golden[:]), string(actual[:]))
+			}
+			if bytes.Contains(actual, []byte("secret-")) {
+				t.Errorf("startup message leaks a secret:\n%s", actual)
+			}
+		})
+	}
 }
 
 func TestCompileRegexps(t *testing.T) {
@@ -170,7 +219,7 @@ func TestLoadKeyValuesFromDisk(t *testing.T) {
 			}()
 
 			actual := kv.NewList()
-			err = loadKeyValuesFromDisk(actual, dirIgnoreRe, fileIgnoreRe)
+			_, err = loadKeyValuesFromDisk(actual, dirIgnoreRe, fileIgnoreRe)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -196,6 +245,28 @@ func TestLoadKeyValuesFromDisk(t *testing.T) {
 	}
 }
 
+func TestLoadKeyValuesFromDiskMissingDirectory(t *testing.T) {
+	os.Clearenv()
+	err := os.Setenv("D2C_DIRECTORY", "testdata/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory that's gone is an error the caller can retry, not an exit
+	_, err = loadKeyValuesFromDisk(kv.NewList(), regexp.MustCompile(`a^`), regexp.MustCompile(`a^`))
+	if err == nil || !strings.Contains(err.Error(), "testdata/missing") {
+		t.Errorf("expected an error naming the directory, got %v", err)
+	}
+	if wd, _ := os.Getwd(); wd != old {
+		t.Errorf("expected to stay in %s, now in %s", old, wd)
+	}
+}
+
 func TestFindDefaults(t *testing.T) {
 	cases := []struct {
 		name   string
@@ -390,15 +461,9 @@ func TestLoadFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	for idx, key := range v2.AllKeys() {
-		// We should only have one key...
-		if idx > 0 {
-			t.Errorf("We got more than 1 key on a typeless default file being loaded as a blob...")
-		} else {
-			if viper.GetBool("VERBOSE") {
-				fmt.Println(idx, key, "=", v2.GetString(key))
-			}
-		}
+	// A typeless file has no keys to merge
+	if len(v2.AllKeys()) != 0 {
+		t.Errorf("We got keys %v on a typeless default file, which has none to merge", v2.AllKeys())
 	}
 
 	os.Clearenv()
@@ -443,3 +508,87 @@ func TestLoadFile(t *testing.T) {
 	}
 
 }
+
+func TestSyncConsulConflict(t *testing.T) {
+	cases := []struct {
+		name       string
+		onConflict string
+		expectErr  bool
+		expect     string
+	}{
+		{"abort", "abort", true, "edited"},
+		{"replan", "replan", false, "file"},
+		{"unknown", "ignore", true, "consul"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			err := os.Setenv("D2C_ON_CONFLICT", tc.onConflict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			fake, client := newFakeConsul(t, map[string]string{"dir2consul/key": "consul"})
+			edited := false
+			fake.beforeTxn = func() {
+				// Someone else edits the key between the List and the first write
+				if !edited {
+					edited = true
+					fake.set("dir2consul/key", "edited")
+				}
+			}
+
+			fileKeyValues := kv.NewList()
+			_, _, _ = fileKeyValues.Set("dir2consul/key", []byte("file"))
+
+			_, err = syncConsul(fileKeyValues, nil, client)
+			if tc.expectErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tc.expectErr && err != nil {
+				t.Error(err)
+			}
+			if actual := fake.values()["dir2consul/key"]; actual != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, actual)
+			}
+		})
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	cases := []struct {
+		name   string
+		consul map[string]string
+		expect bool
+	}{
+		{"match", map[string]string{"dir2consul/key": "file"}, false},
+		{"changed", map[string]string{"dir2consul/key": "consul"}, true},
+		{"missing", nil, true},
+		{"extra", map[string]string{"dir2consul/key": "file", "dir2consul/extra": "x"}, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			setupEnvironment()
+
+			fake, client := newFakeConsul(t, tc.consul)
+
+			fileKeyValues := kv.NewList()
+			_, _, _ = fileKeyValues.Set("dir2consul/key", []byte("file"))
+
+			drift, err := checkDrift(fileKeyValues, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if drift != tc.expect {
+				t.Errorf("expected drift %t, got %t", tc.expect, drift)
+			}
+			if fake.txns != 0 {
+				t.Error("a drift check must not write to Consul")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// keyMatcher matches Consul keys against a list of globs and a regular expression.
+// Keys are matched relative to CONSUL_KEY_PREFIX.
+type keyMatcher struct {
+	globs []string
+	re    *regexp.Regexp
+}
+
+// newKeyMatcher compiles a comma separated list of globs and a regular expression into a keyMatcher.
+// Globs use path.Match syntax, so "*" does not match across a "/".
+func newKeyMatcher(globs string, pcre string) (*keyMatcher, error) {
+	m := &keyMatcher{}
+	for _, glob := range strings.Split(globs, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("Bad glob %q: %v", glob, err)
+		}
+		m.globs = append(m.globs, glob)
+	}
+
+	re, err := regexp.Compile(pcre)
+	if err != nil {
+		return nil, err
+	}
+	m.re = re
+	return m, nil
+}
+
+// match is true when the key matches any of the globs or the regular expression
+func (m *keyMatcher) match(key string) bool {
+	rel := relativeKey(key)
+	for _, glob := range m.globs {
+		if ok, _ := path.Match(glob, rel); ok {
+			return true
+		}
+	}
+	return m.re.MatchString(rel)
+}
+
+// relativeKey strips CONSUL_KEY_PREFIX from key
+func relativeKey(key string) string {
+	return strings.TrimPrefix(key, viper.GetString("CONSUL_KEY_PREFIX")+"/")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestKeyMatcher(t *testing.T) {
+	cases := []struct {
+		name   string
+		globs  string
+		re     string
+		key    string
+		expect bool
+	}{
+		{"no patterns", "", `a^`, "dir2consul/leader", false},
+		{"glob", "leader", `a^`, "dir2consul/leader", true},
+		{"glob in list", "x, */leader ,y", `a^`, "dir2consul/app/leader", true},
+		{"glob does not cross slash", "*", `a^`, "dir2consul/app/leader", false},
+		{"glob is relative to prefix", "dir2consul/leader", `a^`, "dir2consul/leader", false},
+		{"regex", "", `^migrations/`, "dir2consul/migrations/version", true},
+		{"regex miss", "", `^migrations/`, "dir2consul/app/migrations/version", false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			setupEnvironment()
+
+			m, err := newKeyMatcher(tc.globs, tc.re)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.match(tc.key) != tc.expect {
+				t.Errorf("expected match(%s) to be %t", tc.key, tc.expect)
+			}
+		})
+	}
+
+	_, err := newKeyMatcher("[", `a^`)
+	if err == nil {
+		t.Error("expected a bad glob to fail")
+	}
+	_, err = newKeyMatcher("", `(`)
+	if err == nil {
+		t.Error("expected a bad regex to fail")
+	}
+}
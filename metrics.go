@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/spf13/viper"
+)
+
+// setupMetrics sends metrics to the sink at METRICS_SINK, a URL such as
+// statsd://127.0.0.1:8125. Without one, metrics are kept in memory and
+// sending dir2consul SIGUSR1 dumps them to stderr.
+func setupMetrics() error {
+	var sink metrics.MetricSink
+	if url := viper.GetString("METRICS_SINK"); url != "" {
+		var err error
+		sink, err = metrics.NewMetricSinkFromURL(url)
+		if err != nil {
+			return fmt.Errorf("Error setting up D2C_METRICS_SINK %s: %v", url, err)
+		}
+	} else {
+		inmem := metrics.NewInmemSink(10*time.Second, time.Minute)
+		metrics.DefaultInmemSignal(inmem)
+		sink = inmem
+	}
+
+	conf := metrics.DefaultConfig("dir2consul")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(conf, sink)
+	return err
+}
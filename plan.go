@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// planAction is what a sync does to a single key
+type planAction string
+
+const (
+	actionAdd       planAction = "add"
+	actionUpdate    planAction = "update"
+	actionDelete    planAction = "delete"
+	actionUnchanged planAction = "unchanged"
+	actionSkip      planAction = "skip"
+)
+
+// planValue summarizes a value without revealing it
+type planValue struct {
+	Size int    `json:"size"`
+	Hash string `json:"sha256"`
+}
+
+// planEntry is the planned change for a single key
+type planEntry struct {
+	Key    string     `json:"key"`
+	Action planAction `json:"action"`
+	Old    *planValue `json:"old,omitempty"`
+	New    *planValue `json:"new,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+
+	// Redacted marks keys whose values are hidden from verbose logs
+	Redacted bool `json:"redacted,omitempty"`
+
+	// value and flags are what to write, and index the ModifyIndex to check-and-set against
+	value []byte
+	flags uint64
+	index uint64
+}
+
+// plan lists the changes needed to make Consul match the file data
+type plan struct {
+	Prefix  string      `json:"prefix"`
+	Entries []planEntry `json:"entries"`
+
+	// consulPairs are the Consul pairs the plan was made from
+	consulPairs map[string]*api.KVPair
+}
+
+// newPlanValue returns the size and hash of value
+func newPlanValue(value []byte) *planValue {
+	sum := sha256.Sum256(value)
+	return &planValue{Size: len(value), Hash: hex.EncodeToString(sum[:])}
+}
+
+// newPlan compares the file data to the Consul data and returns a plan covering every key in either.
+// consulPairs holds the listed Consul pairs; the plan's writes check-and-set against their ModifyIndex.
+//
+// When OWNER_FLAGS is set, keys dir2consul writes are marked with those flags
+// and only keys carrying them are deleted. Existing keys without the flags are
+// skipped, unless ADOPT is set, in which case file keys are claimed by
+// rewriting them with the flags.
+func newPlan(fileKeyValues *kv.List, consulKeyValues *kv.List, consulPairs map[string]*api.KVPair) *plan {
+	p := &plan{Prefix: viper.GetString("CONSUL_KEY_PREFIX"), Entries: []planEntry{}, consulPairs: consulPairs}
+
+	ownerFlags := viper.GetUint64("OWNER_FLAGS")
+	owned := func(key string) bool {
+		return ownerFlags == 0 || consulPairs[key] == nil || consulPairs[key].Flags == ownerFlags
+	}
+	index := func(key string) uint64 {
+		if consulPairs[key] == nil {
+			return 0
+		}
+		return consulPairs[key].ModifyIndex
+	}
+
+	for _, key := range fileKeyValues.Keys() {
+		_, fb, _ := fileKeyValues.Get(key, nil)
+		_, cb, err := consulKeyValues.Get(key, nil)
+		e := planEntry{Key: key, New: newPlanValue(fb), value: fb, flags: ownerFlags, index: index(key)}
+		switch {
+		case err == kv.ErrNxKey:
+			e.Action = actionAdd
+		case !owned(key) && viper.GetBool("ADOPT"):
+			e.Action = actionUpdate
+			e.Old = newPlanValue(cb)
+			e.Reason = "adopt"
+		case !owned(key):
+			e.Action = actionSkip
+			e.Old = newPlanValue(cb)
+			e.Reason = "not owned"
+		case bytes.Equal(fb, cb):
+			e.Action = actionUnchanged
+			e.Old = e.New
+		default:
+			e.Action = actionUpdate
+			e.Old = newPlanValue(cb)
+		}
+		p.Entries = append(p.Entries, e)
+	}
+
+	for _, key := range consulKeyValues.Keys() {
+		_, _, err := fileKeyValues.Get(key, nil)
+		if err == kv.ErrNxKey {
+			_, cb, _ := consulKeyValues.Get(key, nil)
+			e := planEntry{Key: key, Action: actionDelete, Old: newPlanValue(cb), index: index(key)}
+			if !owned(key) {
+				e.Action = actionSkip
+				e.Reason = "not owned"
+			}
+			p.Entries = append(p.Entries, e)
+		}
+	}
+
+	sort.Slice(p.Entries, func(i, j int) bool { return p.Entries[i].Key < p.Entries[j].Key })
+	p.markRedacted()
+	return p
+}
+
+// markRedacted flags entries whose old or new value is sensitive, so the plan shows they are redacted in logs
+func (p *plan) markRedacted() {
+	for i := range p.Entries {
+		e := &p.Entries[i]
+		e.Redacted = redaction.sensitive(e.Key, e.value)
+		if c, ok := p.consulPairs[e.Key]; ok && !e.Redacted {
+			e.Redacted = redaction.sensitive(e.Key, c.Value)
+		}
+	}
+}
+
+// skip marks entries for keys matching m as skipped for reason, so the plan neither writes nor deletes them
+func (p *plan) skip(m *keyMatcher, reason string) {
+	for i := range p.Entries {
+		if m.match(p.Entries[i].Key) {
+			p.Entries[i].Action = actionSkip
+			p.Entries[i].Reason = reason
+		}
+	}
+}
+
+// skipUnmanaged marks protected keys and the lock key as skipped
+func (p *plan) skipUnmanaged() error {
+	protected, err := newKeyMatcher(viper.GetString("PROTECTED_KEYS"), viper.GetString("PROTECTED_KEY_REGEX"))
+	if err != nil {
+		return fmt.Errorf("Protected keys failed to compile: %v", err)
+	}
+	p.skip(protected, "protected")
+	if viper.GetString("LOCK_KEY") != "" {
+		p.skipKey(viper.GetString("LOCK_KEY"), "lock")
+	}
+	return nil
+}
+
+// skipOutside marks changes to keys outside scope as skipped, so only the keys in scope are synced
+func (p *plan) skipOutside(scope keyScope) {
+	for i := range p.Entries {
+		e := &p.Entries[i]
+		if !scope.contains(e.Key) && e.Action != actionUnchanged && e.Action != actionSkip {
+			e.Action = actionSkip
+			e.Reason = "not changed"
+		}
+	}
+}
+
+// skipKey marks the entry for key, if any, as skipped for reason
+func (p *plan) skipKey(key string, reason string) {
+	for i := range p.Entries {
+		if p.Entries[i].Key == key {
+			p.Entries[i].Action = actionSkip
+			p.Entries[i].Reason = reason
+		}
+	}
+}
+
+// count returns the number of entries with action
+func (p *plan) count(action planAction) int {
+	n := 0
+	for _, e := range p.Entries {
+		if e.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// hasChanges is true when applying the plan would modify Consul
+func (p *plan) hasChanges() bool {
+	return p.count(actionAdd)+p.count(actionUpdate)+p.count(actionDelete) > 0
+}
+
+// checkDeleteLimits refuses plans that delete more keys than MAX_DELETES or
+// MAX_DELETE_PERCENT allow, and plans that would delete every key, as happens
+// when the file tree is empty. FORCE_DELETE overrides the check.
+func (p *plan) checkDeleteLimits() error {
+	deletes := p.count(actionDelete)
+	if deletes == 0 || viper.GetBool("FORCE_DELETE") {
+		return nil
+	}
+
+	// Skipped keys aren't managed by dir2consul, so they don't count either way
+	fileKeys := p.count(actionAdd) + p.count(actionUpdate) + p.count(actionUnchanged)
+	consulKeys := p.count(actionUpdate) + p.count(actionUnchanged) + deletes
+	percent := float64(deletes) * 100 / float64(consulKeys)
+
+	switch {
+	case fileKeys == 0:
+		return fmt.Errorf("Refusing to delete all %d keys under %s because there are no keys to replace them; set D2C_FORCE_DELETE to override",
+			deletes, p.Prefix)
+	case viper.GetInt("MAX_DELETES") >= 0 && deletes > viper.GetInt("MAX_DELETES"):
+		return fmt.Errorf("Refusing to delete %d keys under %s: D2C_MAX_DELETES is %d; set D2C_FORCE_DELETE to override",
+			deletes, p.Prefix, viper.GetInt("MAX_DELETES"))
+	case percent > viper.GetFloat64("MAX_DELETE_PERCENT"):
+		return fmt.Errorf("Refusing to delete %d of %d keys (%.1f%%) under %s: D2C_MAX_DELETE_PERCENT is %v; set D2C_FORCE_DELETE to override",
+			deletes, consulKeys, percent, p.Prefix, viper.GetFloat64("MAX_DELETE_PERCENT"))
+	}
+	return nil
+}
+
+// txnOps returns the check-and-set operations that carry out the plan.
+// Adds use an index of 0 so they fail if the key was created in the meantime.
+// Sync writes carry OWNER_FLAGS so later runs know dir2consul owns the key.
+func (p *plan) txnOps() api.TxnOps {
+	var ops api.TxnOps
+	for _, e := range p.Entries {
+		switch e.Action {
+		case actionAdd, actionUpdate:
+			if viper.GetBool("VERBOSE") {
+				log.Printf("SET key: %s value: %s\n", e.Key, redact(e.Key, e.value))
+			}
+			ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: e.Key, Value: e.value, Flags: e.flags, Index: e.index}})
+		case actionDelete:
+			if viper.GetBool("VERBOSE") {
+				log.Printf("DELETE key: %s\n", e.Key)
+			}
+			ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: e.Key, Index: e.index}})
+		}
+	}
+	return ops
+}
+
+// text renders the plan for people to read
+func (p *plan) text() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Plan for %s: %d to add, %d to update, %d to delete, %d unchanged, %d skipped\n",
+		p.Prefix, p.count(actionAdd), p.count(actionUpdate), p.count(actionDelete), p.count(actionUnchanged), p.count(actionSkip))
+
+	symbols := map[planAction]string{
+		actionAdd:       "+",
+		actionUpdate:    "~",
+		actionDelete:    "-",
+		actionUnchanged: "=",
+		actionSkip:      "!",
+	}
+	short := func(v *planValue) string {
+		return fmt.Sprintf("%d bytes sha256:%.12s", v.Size, v.Hash)
+	}
+	for _, e := range p.Entries {
+		var detail string
+		switch e.Action {
+		case actionAdd:
+			detail = "new: " + short(e.New)
+		case actionUpdate:
+			detail = "old: " + short(e.Old) + ", new: " + short(e.New)
+		case actionDelete:
+			detail = "old: " + short(e.Old)
+		case actionUnchanged:
+			detail = short(e.New)
+		case actionSkip:
+			detail = e.Reason
+		}
+		if e.Redacted {
+			detail += ", redacted"
+		}
+		fmt.Fprintf(&buf, "  %s %-9s %s (%s)\n", symbols[e.Action], e.Action, e.Key, detail)
+	}
+	return buf.Bytes()
+}
+
+// writePlan writes the plan in PLAN_FORMAT to PLAN_FILE, or to stdout when no file is set
+func writePlan(p *plan) error {
+	var out []byte
+	switch viper.GetString("PLAN_FORMAT") {
+	case "text":
+		out = p.text()
+	case "json":
+		var err error
+		out, err = json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		out = append(out, '\n')
+	default:
+		return fmt.Errorf("Unknown D2C_PLAN_FORMAT value %q: use text or json", viper.GetString("PLAN_FORMAT"))
+	}
+
+	if viper.GetString("PLAN_FILE") == "" {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	return ioutil.WriteFile(viper.GetString("PLAN_FILE"), out, 0644)
+}
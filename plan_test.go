@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// testPlan returns a plan with one key of each action
+func testPlan() *plan {
+	fileKeyValues := kv.NewList()
+	_, _, _ = fileKeyValues.Set("dir2consul/add", []byte("added"))
+	_, _, _ = fileKeyValues.Set("dir2consul/update", []byte("new"))
+	_, _, _ = fileKeyValues.Set("dir2consul/same", []byte("same"))
+	_, _, _ = fileKeyValues.Set("dir2consul/db_password", []byte("hunter2"))
+
+	consulKeyValues := kv.NewList()
+	_, _, _ = consulKeyValues.Set("dir2consul/update", []byte("old"))
+	_, _, _ = consulKeyValues.Set("dir2consul/same", []byte("same"))
+	_, _, _ = consulKeyValues.Set("dir2consul/delete", []byte("gone"))
+	_, _, _ = consulKeyValues.Set("dir2consul/leader", []byte("node1"))
+
+	consulPairs := map[string]*api.KVPair{
+		"dir2consul/update": {Key: "dir2consul/update", ModifyIndex: 7},
+		"dir2consul/same":   {Key: "dir2consul/same", ModifyIndex: 8},
+		"dir2consul/delete": {Key: "dir2consul/delete", ModifyIndex: 9},
+	}
+
+	p := newPlan(fileKeyValues, consulKeyValues, consulPairs)
+	protected, _ := newKeyMatcher("leader", `a^`)
+	p.skip(protected, "protected")
+	return p
+}
+
+func TestNewPlan(t *testing.T) {
+	os.Clearenv()
+	setupEnvironment()
+
+	p := testPlan()
+	expect := map[string]planAction{
+		"dir2consul/add":         actionAdd,
+		"dir2consul/db_password": actionAdd,
+		"dir2consul/delete":      actionDelete,
+		"dir2consul/leader":      actionSkip,
+		"dir2consul/same":        actionUnchanged,
+		"dir2consul/update":      actionUpdate,
+	}
+	if len(p.Entries) != len(expect) {
+		t.Fatalf("expected %d entries, got %d", len(expect), len(p.Entries))
+	}
+	for _, e := range p.Entries {
+		if e.Action != expect[e.Key] {
+			t.Errorf("key %s: expected %s, got %s", e.Key, expect[e.Key], e.Action)
+		}
+	}
+	if !p.hasChanges() {
+		t.Error("plan should have changes")
+	}
+
+	ops := p.txnOps()
+	expectOps := []api.KVTxnOp{
+		{Verb: api.KVCAS, Key: "dir2consul/add", Value: []byte("added"), Index: 0},
+		{Verb: api.KVCAS, Key: "dir2consul/db_password", Value: []byte("hunter2"), Index: 0},
+		{Verb: api.KVDeleteCAS, Key: "dir2consul/delete", Index: 9},
+		{Verb: api.KVCAS, Key: "dir2consul/update", Value: []byte("new"), Index: 7},
+	}
+	if len(ops) != len(expectOps) {
+		t.Fatalf("expected %d operations, got %d", len(expectOps), len(ops))
+	}
+	for i, op := range ops {
+		e := expectOps[i]
+		if op.KV.Verb != e.Verb || op.KV.Key != e.Key || !bytes.Equal(op.KV.Value, e.Value) || op.KV.Index != e.Index {
+			t.Errorf("operation %d: expected %+v, got %+v", i, e, *op.KV)
+		}
+	}
+}
+
+func TestPlanOutput(t *testing.T) {
+	cases := []struct {
+		format string
+		golden string
+	}{
+		{"text", "testdata/plan_text.golden"},
+		{"json", "testdata/plan_json.golden"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			os.Clearenv()
+			setupEnvironment()
+
+			planFile, err := ioutil.TempFile("", "plan")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.Remove(planFile.Name()) }()
+			_ = planFile.Close()
+
+			err = os.Setenv("D2C_PLAN_FORMAT", tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_PLAN_FILE", planFile.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = writePlan(testPlan())
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := ioutil.ReadFile(planFile.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.format == "json" && !json.Valid(actual) {
+				t.Errorf("plan is not valid JSON:\n%s", actual)
+			}
+
+			if *update {
+				err = ioutil.WriteFile(tc.golden, actual, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := ioutil.ReadFile(tc.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(golden, actual) {
+				t.Errorf("failed\nexpected:\n%s\ngot:\n%s", golden, actual)
+			}
+		})
+	}
+}
+
+func TestCheckDeleteLimits(t *testing.T) {
+	cases := []struct {
+		name      string
+		files     int
+		consul    int
+		env       map[string]string
+		expectErr bool
+	}{
+		{"defaults allow deletes", 5, 10, nil, false},
+		{"empty tree refused", 0, 10, nil, true},
+		{"empty tree forced", 0, 10, map[string]string{"D2C_FORCE_DELETE": "true"}, false},
+		{"empty tree and empty consul", 0, 0, nil, false},
+		{"under count", 5, 10, map[string]string{"D2C_MAX_DELETES": "5"}, false},
+		{"over count", 5, 10, map[string]string{"D2C_MAX_DELETES": "4"}, true},
+		{"over count forced", 5, 10, map[string]string{"D2C_MAX_DELETES": "4", "D2C_FORCE_DELETE": "true"}, false},
+		{"under percent", 5, 10, map[string]string{"D2C_MAX_DELETE_PERCENT": "50"}, false},
+		{"over percent", 5, 10, map[string]string{"D2C_MAX_DELETE_PERCENT": "49.9"}, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range tc.env {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			// The first tc.files Consul keys are also in the files, the rest are deleted
+			fileKeyValues := kv.NewList()
+			consulKeyValues := kv.NewList()
+			for n := 0; n < tc.consul; n++ {
+				key := fmt.Sprintf("dir2consul/key%d", n)
+				_, _, _ = consulKeyValues.Set(key, []byte("v"))
+				if n < tc.files {
+					_, _, _ = fileKeyValues.Set(key, []byte("v"))
+				}
+			}
+
+			err := newPlan(fileKeyValues, consulKeyValues, nil).checkDeleteLimits()
+			if tc.expectErr && err == nil {
+				t.Error("expected the deletes to be refused")
+			}
+			if !tc.expectErr && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewPlanOwnership(t *testing.T) {
+	cases := []struct {
+		name   string
+		env    map[string]string
+		expect map[string]planAction
+	}{
+		{
+			"ownership disabled",
+			nil,
+			map[string]planAction{
+				"dir2consul/mine":        actionUnchanged,
+				"dir2consul/theirs":      actionUnchanged,
+				"dir2consul/old-mine":    actionDelete,
+				"dir2consul/old-theirs":  actionDelete,
+				"dir2consul/new":         actionAdd,
+				"dir2consul/theirs-diff": actionUpdate,
+			},
+		},
+		{
+			"ownership enabled",
+			map[string]string{"D2C_OWNER_FLAGS": "3372"},
+			map[string]planAction{
+				"dir2consul/mine":        actionUnchanged,
+				"dir2consul/theirs":      actionSkip,
+				"dir2consul/old-mine":    actionDelete,
+				"dir2consul/old-theirs":  actionSkip,
+				"dir2consul/new":         actionAdd,
+				"dir2consul/theirs-diff": actionSkip,
+			},
+		},
+		{
+			"adopt",
+			map[string]string{"D2C_OWNER_FLAGS": "3372", "D2C_ADOPT": "true"},
+			map[string]planAction{
+				"dir2consul/mine":        actionUnchanged,
+				"dir2consul/theirs":      actionUpdate,
+				"dir2consul/old-mine":    actionDelete,
+				"dir2consul/old-theirs":  actionSkip,
+				"dir2consul/new":         actionAdd,
+				"dir2consul/theirs-diff": actionUpdate,
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range tc.env {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			fileKeyValues := kv.NewList()
+			_, _, _ = fileKeyValues.Set("dir2consul/mine", []byte("v"))
+			_, _, _ = fileKeyValues.Set("dir2consul/theirs", []byte("v"))
+			_, _, _ = fileKeyValues.Set("dir2consul/theirs-diff", []byte("new"))
+			_, _, _ = fileKeyValues.Set("dir2consul/new", []byte("v"))
+
+			consulKeyValues := kv.NewList()
+			consulPairs := map[string]*api.KVPair{
+				"dir2consul/mine":        {Flags: 3372},
+				"dir2consul/theirs":      {Flags: 0},
+				"dir2consul/theirs-diff": {Flags: 42},
+				"dir2consul/old-mine":    {Flags: 3372},
+				"dir2consul/old-theirs":  {Flags: 0},
+			}
+			for key, pair := range consulPairs {
+				pair.Key = key
+				pair.Value = []byte("v")
+				_, _, _ = consulKeyValues.Set(key, pair.Value)
+			}
+
+			p := newPlan(fileKeyValues, consulKeyValues, consulPairs)
+			for _, e := range p.Entries {
+				if e.Action != tc.expect[e.Key] {
+					t.Errorf("key %s: expected %s, got %s", e.Key, tc.expect[e.Key], e.Action)
+				}
+			}
+			for _, op := range p.txnOps() {
+				if op.KV.Verb == api.KVCAS && op.KV.Flags != viper.GetUint64("OWNER_FLAGS") {
+					t.Errorf("key %s written with flags %d", op.KV.Key, op.KV.Flags)
+				}
+			}
+		})
+	}
+}
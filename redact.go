@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+// minEntropyLength is the shortest value the entropy check considers.
+// Short values don't carry enough characters to tell random from readable.
+const minEntropyLength = 16
+
+// redactor decides which values are kept out of logs and plans
+type redactor struct {
+	keys    *keyMatcher
+	values  *regexp.Regexp
+	entropy float64
+}
+
+// redaction is the redactor built from the environment by setupRedaction
+var redaction = &redactor{keys: &keyMatcher{re: regexp.MustCompile("a^")}, values: regexp.MustCompile("a^")}
+
+// setupRedaction builds the redaction rules from REDACT_KEYS, REDACT_KEY_REGEX,
+// REDACT_VALUE_REGEX and REDACT_ENTROPY
+func setupRedaction() error {
+	keys, err := newKeyMatcher(viper.GetString("REDACT_KEYS"), viper.GetString("REDACT_KEY_REGEX"))
+	if err != nil {
+		return fmt.Errorf("Error compiling D2C_REDACT_KEYS or D2C_REDACT_KEY_REGEX: %v", err)
+	}
+	values, err := regexp.Compile(viper.GetString("REDACT_VALUE_REGEX"))
+	if err != nil {
+		return fmt.Errorf("Error compiling D2C_REDACT_VALUE_REGEX: %v", err)
+	}
+	redaction = &redactor{keys: keys, values: values, entropy: viper.GetFloat64("REDACT_ENTROPY")}
+	return nil
+}
+
+// sensitive is true when the key matches the key rules, the value matches the
+// value regex, or the value looks random enough to be a generated secret
+func (r *redactor) sensitive(key string, value []byte) bool {
+	if r.keys.match(key) || r.values.Match(value) {
+		return true
+	}
+	return r.entropy > 0 && len(value) >= minEntropyLength && shannonEntropy(value) >= r.entropy
+}
+
+// redact returns value for logging: as is, or as its length and hash when it is sensitive
+func redact(key string, value []byte) string {
+	if !redaction.sensitive(key, value) {
+		return string(value)
+	}
+	sum := sha256.Sum256(value)
+	return fmt.Sprintf("<redacted %d bytes sha256:%.12s>", len(value), hex.EncodeToString(sum[:]))
+}
+
+// shannonEntropy returns the bits of entropy per byte of value
+func shannonEntropy(value []byte) float64 {
+	var counts [256]int
+	for _, b := range value {
+		counts[b]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(value))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
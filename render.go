@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// runRender loads DIRECTORY without connecting to Consul and writes the keys
+// and values a sync would write to w, in RENDER_FORMAT
+func runRender(w io.Writer) error {
+	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
+	if err != nil {
+		return err
+	}
+
+	fileKeyValues := kv.NewList()
+	report, err := loadKeyValuesFromDisk(fileKeyValues, dirIgnoreRe, fileIgnoreRe)
+	if err != nil {
+		return err
+	}
+	err = report.check(viper.GetBool("STRICT"))
+	if err != nil {
+		return err
+	}
+	var provenance map[string][]keySource
+	if viper.GetBool("RENDER_SOURCES") {
+		provenance = report.provenance
+	}
+	return renderKeyValues(w, fileKeyValues, viper.GetString("RENDER_FORMAT"), provenance)
+}
+
+// renderedKey is a key in the json and yaml formats when sources are rendered
+type renderedKey struct {
+	Value   string   `json:"value" yaml:"value"`
+	Sources []string `json:"sources" yaml:"sources"`
+}
+
+// renderKeyValues writes kvs to w, sorted by key. The text format is the one
+// used by kv.List.Serialize, and the consul format is the JSON read by
+// `consul kv import`. With provenance, the files that set each key are
+// rendered too, except in the consul format which has nowhere to put them.
+func renderKeyValues(w io.Writer, kvs *kv.List, format string, provenance map[string][]keySource) error {
+	if provenance != nil && format == "consul" {
+		return fmt.Errorf("D2C_RENDER_SOURCES can't be used with the consul format")
+	}
+	keys := kvs.Keys()
+	sort.Strings(keys)
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		_, value, err := kvs.Get(key, nil)
+		if err != nil {
+			return err
+		}
+		values[key] = string(value)
+	}
+
+	// Maps marshal with their keys sorted
+	var rendered interface{} = values
+	if provenance != nil {
+		withSources := make(map[string]renderedKey, len(keys))
+		for _, key := range keys {
+			withSources[key] = renderedKey{Value: values[key], Sources: sourceFiles(provenance[key])}
+		}
+		rendered = withSources
+	}
+
+	var out []byte
+	var err error
+	switch format {
+	case "text":
+		var buf bytes.Buffer
+		for _, key := range keys {
+			// The file that won goes before the separator, where a value can't confuse it
+			if files := sourceFiles(provenance[key]); len(files) > 0 {
+				_, _ = buf.WriteString(key + " [" + files[len(files)-1] + "]")
+			} else {
+				_, _ = buf.WriteString(key)
+			}
+			_, _ = buf.WriteString(" : " + values[key] + "\n")
+		}
+		out = buf.Bytes()
+	case "json":
+		out, err = json.MarshalIndent(rendered, "", "  ")
+		out = append(out, '\n')
+	case "yaml":
+		out, err = yaml.Marshal(rendered)
+	case "consul":
+		entries := make([]backupEntry, 0, len(keys))
+		for _, key := range keys {
+			entries = append(entries, backupEntry{Key: key, Flags: viper.GetUint64("OWNER_FLAGS"), Value: base64.StdEncoding.EncodeToString([]byte(values[key]))})
+		}
+		out, err = json.MarshalIndent(entries, "", "\t")
+		out = append(out, '\n')
+	default:
+		return fmt.Errorf("Unknown D2C_RENDER_FORMAT value %q: use text, json, yaml or consul", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// sourceFiles returns the files in sources
+func sourceFiles(sources []keySource) []string {
+	files := make([]string, 0, len(sources))
+	for _, source := range sources {
+		files = append(files, source.File)
+	}
+	return files
+}
+
+// runExplain loads DIRECTORY without connecting to Consul and writes to w
+// every file that set key, or each key below it, in precedence order with the
+// value each one set, marking the one that won. key may leave out
+// CONSUL_KEY_PREFIX. Sensitive values are redacted.
+func runExplain(w io.Writer, key string) error {
+	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
+	if err != nil {
+		return err
+	}
+
+	fileKeyValues := kv.NewList()
+	report, err := loadKeyValuesFromDisk(fileKeyValues, dirIgnoreRe, fileIgnoreRe)
+	if err != nil {
+		return err
+	}
+	err = report.check(viper.GetBool("STRICT"))
+	if err != nil {
+		return err
+	}
+
+	prefix := viper.GetString("CONSUL_KEY_PREFIX")
+	key = strings.Trim(key, "/")
+	if key != prefix && !strings.HasPrefix(key, prefix+"/") {
+		key = prefix + "/" + key
+	}
+	var keys []string
+	for _, k := range fileKeyValues.Keys() {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("No file in %s loads %s", viper.GetString("DIRECTORY"), key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		_, value, err := fileKeyValues.Get(k, nil)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(&buf, "%s = %q\n", k, redact(k, value))
+		sources := report.provenance[k]
+		for i, source := range sources {
+			won := ""
+			if i == len(sources)-1 {
+				won = " (wins)"
+			}
+			_, _ = fmt.Fprintf(&buf, "\t%d. %s: %q%s\n", i+1, source.File, redact(k, []byte(source.Value)), won)
+		}
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"default.yaml":       "region: us\n",
+		"app/default.yaml":   "region: eu\ntimeout: 30\n",
+		"app/config.yaml":    "port: 8080\n",
+		"app/motd":           "hello\nworld\n",
+		"web.properties":     "listen=:8080\n",
+		"web/certs/ca.crt":   "-----BEGIN CERTIFICATE-----\n",
+		"ignored/README.md":  "not loaded",
+		"app/empty.json":     "{}",
+		"app/quoted.json":    `{"say": "\"hi\""}`,
+		"app/unicode.yaml":   "greeting: héllo ☃\n",
+		"app/nested/db.yaml": "db:\n  host: localhost\n  port: 5432\n",
+	})
+
+	cases := []struct {
+		format  string
+		sources bool
+		golden  string
+	}{
+		{"text", false, "render_text"},
+		{"json", false, "render_json"},
+		{"yaml", false, "render_yaml"},
+		{"consul", false, "render_consul"},
+		{"text", true, "render_text_sources"},
+		{"json", true, "render_json_sources"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.golden), func(t *testing.T) {
+			os.Clearenv()
+			err := os.Setenv("D2C_DIRECTORY", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_RENDER_FORMAT", tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_RENDER_SOURCES", fmt.Sprint(tc.sources))
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			var actual bytes.Buffer
+			err = runRender(&actual)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goldenFile := fmt.Sprintf("testdata/%s.golden", tc.golden)
+			if *update {
+				err = ioutil.WriteFile(goldenFile, actual.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := ioutil.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(golden, actual.Bytes()) {
+				t.Errorf("expected:\n%s\ngot:\n%s", golden, actual.Bytes())
+			}
+		})
+	}
+
+	os.Clearenv()
+	err := os.Setenv("D2C_DIRECTORY", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_RENDER_FORMAT", "xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+	err = runRender(ioutil.Discard)
+	if err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"default.yaml":     "region: us\ndb_password: hunter2\n",
+		"app/default.yaml": "region: eu\ntimeout: 30\n",
+		"app/config.yaml":  "region: ap\nport: 8080\n",
+		"app/motd":         "hello",
+	})
+
+	cases := []struct {
+		key    string
+		expect string
+	}{
+		{
+			"dir2consul/app/config/region",
+			"dir2consul/app/config/region = \"ap\"\n" +
+				"\t1. default.yaml: \"us\"\n" +
+				"\t2. app/default.yaml: \"eu\"\n" +
+				"\t3. app/config.yaml: \"ap\" (wins)\n",
+		},
+		{
+			"app/config/timeout",
+			"dir2consul/app/config/timeout = \"30\"\n" +
+				"\t1. app/default.yaml: \"30\" (wins)\n",
+		},
+		{
+			"app/motd",
+			"dir2consul/app/motd = \"hello\"\n" +
+				"\t1. app/motd: \"hello\" (wins)\n" +
+				"dir2consul/app/motd/db_password = \"<redacted 7 bytes sha256:f52fbd32b2b3>\"\n" +
+				"\t1. default.yaml: \"<redacted 7 bytes sha256:f52fbd32b2b3>\" (wins)\n" +
+				"dir2consul/app/motd/region = \"eu\"\n" +
+				"\t1. default.yaml: \"us\"\n" +
+				"\t2. app/default.yaml: \"eu\" (wins)\n" +
+				"dir2consul/app/motd/timeout = \"30\"\n" +
+				"\t1. app/default.yaml: \"30\" (wins)\n",
+		},
+	}
+	// Files are named the same way when D2C_DIRECTORY is a symlink
+	for j, directory := range []string{dir, symlinkTo(t, dir)} {
+		os.Clearenv()
+		err := os.Setenv("D2C_DIRECTORY", directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setupEnvironment()
+
+		for i, tc := range cases {
+			t.Run(fmt.Sprintf("%d_%d_%s", j, i, tc.key), func(t *testing.T) {
+				var actual bytes.Buffer
+				err := runExplain(&actual, tc.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if actual.String() != tc.expect {
+					t.Errorf("expected:\n%s\ngot:\n%s", tc.expect, actual.String())
+				}
+			})
+		}
+	}
+
+	err := runExplain(ioutil.Discard, "app/missing")
+	if err == nil {
+		t.Error("expected explaining a key no file loads to fail")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// retryableMessages are fragments of Consul errors that are worth retrying.
+// Transaction errors only carry the response body, not the status code.
+var retryableMessages = []string{
+	"Unexpected response code: 5",
+	"No cluster leader",
+	"leadership lost",
+	"rpc error",
+	"connection reset",
+	"connection refused",
+	"EOF",
+}
+
+// jitter randomizes retry waits so runs that failed together don't retry together
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// isRetryable is true for errors that are likely to go away on their own,
+// such as 5xx responses, connection resets and leader elections
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if api.IsRetryableError(err) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	for _, msg := range retryableMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryWait returns how long to wait before retry number attempt: a random
+// duration up to RETRY_MIN_WAIT doubled for every attempt, capped at RETRY_MAX_WAIT
+func retryWait(attempt int) time.Duration {
+	wait := viper.GetDuration("RETRY_MIN_WAIT")
+	for i := 1; i < attempt && wait < viper.GetDuration("RETRY_MAX_WAIT"); i++ {
+		wait *= 2
+	}
+	if wait > viper.GetDuration("RETRY_MAX_WAIT") {
+		wait = viper.GetDuration("RETRY_MAX_WAIT")
+	}
+	if wait <= 0 {
+		return 0
+	}
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(jitter.Int63n(int64(wait))) + 1
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't retryable,
+// or has been tried RETRY_ATTEMPTS times, and returns the last error
+func retry(what string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if !isRetryable(err) || attempt >= viper.GetInt("RETRY_ATTEMPTS") {
+			return err
+		}
+		wait := retryWait(attempt)
+		log.Printf("%s failed, retrying in %s (attempt %d of %d): %s", what, wait, attempt+1, viper.GetInt("RETRY_ATTEMPTS"), err)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{errors.New("Unexpected response code: 500 (rpc error making call: EOF)"), true},
+		{errors.New("Unexpected response code: 503 (service unavailable)"), true},
+		{errors.New("Failed request: No cluster leader"), true},
+		{errors.New("read tcp 10.0.0.1:1234->10.0.0.2:8500: read: connection reset by peer"), true},
+		{errors.New("Unexpected response code: 403 (Permission denied)"), false},
+		{errors.New("Failed request: Permission denied"), false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			if isRetryable(tc.err) != tc.expect {
+				t.Errorf("expected isRetryable(%v) to be %t", tc.err, tc.expect)
+			}
+		})
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	os.Clearenv()
+	err := os.Setenv("D2C_RETRY_MIN_WAIT", "100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_RETRY_MAX_WAIT", "1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	limits := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, limit := range limits {
+		for n := 0; n < 20; n++ {
+			wait := retryWait(i + 1)
+			if wait <= 0 || wait > limit {
+				t.Errorf("attempt %d: wait %s is outside (0, %s]", i+1, wait, limit)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	os.Clearenv()
+	err := os.Setenv("D2C_RETRY_ATTEMPTS", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_RETRY_MIN_WAIT", "1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	calls := 0
+	err = retry("test", func() error {
+		calls++
+		return errors.New("Failed request: No cluster leader")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("expected 3 calls and an error, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = retry("test", func() error {
+		calls++
+		return errors.New("Failed request: Permission denied")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected 1 call and an error, got %d calls and %v", calls, err)
+	}
+}
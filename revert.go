@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// consulWaitTime is how long a blocking query on the prefix waits for a change
+const consulWaitTime = 5 * time.Minute
+
+// watchConsul uses blocking queries to notice changes to the data under
+// CONSUL_KEY_PREFIX and sends on changed for each one, until ctx is done.
+// Sends don't block, so changes that arrive together are reported once.
+func watchConsul(ctx context.Context, consulClient *api.Client, changed chan<- struct{}) {
+	prefix := viper.GetString("CONSUL_KEY_PREFIX")
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	var index uint64
+	for attempt := 1; ctx.Err() == nil; {
+		opts := (&api.QueryOptions{WaitIndex: index, WaitTime: consulWaitTime}).WithContext(ctx)
+		_, meta, err := consulClient.KV().List(prefix+"/", opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wait := retryWait(attempt)
+			log.Printf("Error watching Consul prefix %s, retrying in %s: %s", prefix, wait, err)
+			attempt++
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		attempt = 1
+
+		// The first answer counts as a change too, so edits made before the
+		// watch started are caught. An index that went backwards, as after a
+		// snapshot restore, means starting over.
+		switch {
+		case meta.LastIndex < index:
+			index = 0
+			notify()
+		case meta.LastIndex != index:
+			index = meta.LastIndex
+			notify()
+		}
+	}
+}
+
+// logReverts logs and counts the changes in p to keys outside fileScope.
+// Those keys didn't change on disk, so the changes undo edits made in Consul.
+func logReverts(p *plan, fileScope keyScope) {
+	for _, e := range p.Entries {
+		if e.Action != actionAdd && e.Action != actionUpdate && e.Action != actionDelete {
+			continue
+		}
+		if fileScope.contains(e.Key) {
+			continue
+		}
+		if viper.GetBool("DRYRUN") {
+			log.Printf("Would revert Consul edit to %s (%s)", e.Key, e.Action)
+			continue
+		}
+		log.Printf("Reverted Consul edit to %s (%s)", e.Key, e.Action)
+		metrics.IncrCounterWithLabels([]string{"reverts"}, 1, []metrics.Label{{Name: "action", Value: string(e.Action)}})
+	}
+}
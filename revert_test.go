@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+func TestWatchRevertsConsulEdits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	err = ioutil.WriteFile(filepath.Join(dir, "app.properties"), []byte("port=8080\nhost=db\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Clearenv()
+	for k, v := range map[string]string{
+		"D2C_DIRECTORY":       dir,
+		"D2C_WATCH_CONSUL":    "true",
+		"D2C_WATCH_DEBOUNCE":  "10ms",
+		"D2C_REVERT_INTERVAL": "300ms",
+	} {
+		err = os.Setenv(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupEnvironment()
+
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("dir2consul")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err = metrics.NewGlobal(conf, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake, client := newFakeConsul(t, nil)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- watch(client, stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	waitForValue(t, fake, "dir2consul/app/port", "8080")
+
+	// An edit made in Consul is put back
+	fake.set("dir2consul/app/port", "1")
+	waitForValue(t, fake, "dir2consul/app/port", "8080")
+	first := time.Now()
+
+	// So is a deleted key, but no sooner than REVERT_INTERVAL after the last revert
+	fake.delete("dir2consul/app/host")
+	waitForValue(t, fake, "dir2consul/app/host", "db")
+	if elapsed := time.Since(first); elapsed < 150*time.Millisecond {
+		t.Errorf("reverted again after %s, expected to wait for the revert interval", elapsed)
+	}
+
+	// Reverts are counted just after they are applied
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reverts := make(map[string]float32)
+		for _, interval := range sink.Data() {
+			for key, counter := range interval.Counters {
+				if strings.HasPrefix(key, "dir2consul.reverts") {
+					reverts[key] += float32(counter.Sum)
+				}
+			}
+		}
+		if reverts["dir2consul.reverts;action=update"] == 1 && reverts["dir2consul.reverts;action=add"] == 1 && len(reverts) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one update and one add revert, got %v", reverts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// maxTxnOps is the number of operations Consul accepts in a single transaction
+const maxTxnOps = 64
+
+// maxTxnBytes is Consul's default limit on the size of a transaction request
+// body (txn_max_req_len)
+const maxTxnBytes = 512 * 1024
+
+// txnOpOverhead is a generous allowance for the JSON that wraps each
+// operation's key and value in a transaction request body
+const txnOpOverhead = 256
+
+// txnOpSize estimates how many bytes op adds to a transaction request body.
+// Values are sent base64 encoded, so they count for 4/3 of their raw size.
+func txnOpSize(op *api.TxnOp) int {
+	return base64.StdEncoding.EncodedLen(len(op.KV.Value)) + len(op.KV.Key) + txnOpOverhead
+}
+
+// batchTxnOps splits ops into batches that fit within a single Consul
+// transaction. An operation too large for any transaction gets a batch of
+// its own, which applyTxnOps writes outside of a transaction.
+func batchTxnOps(ops api.TxnOps) []api.TxnOps {
+	var batches []api.TxnOps
+	var batch api.TxnOps
+	size := 0
+	for _, op := range ops {
+		opSize := txnOpSize(op)
+		if len(batch) == maxTxnOps || (len(batch) > 0 && size+opSize > maxTxnBytes) {
+			batches = append(batches, batch)
+			batch = nil
+			size = 0
+		}
+		batch = append(batch, op)
+		size += opSize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// applyTxnOps submits ops to Consul one batch at a time and stops at the
+// first batch that fails. Each batch is applied atomically by Consul, so a
+// failed batch leaves no partial writes behind.
+//
+// Batches that fail with a retryable error are retried. Retrying is safe for
+// check-and-set operations: if a batch went through but the response was lost,
+// the retry is rolled back as a conflict rather than applied twice. A retried
+// batch that conflicts is then checked against Consul, and counts as applied
+// when every key already holds what the batch would have written.
+func applyTxnOps(ops api.TxnOps, consulClient *api.Client) error {
+	batches := batchTxnOps(ops)
+	for i, batch := range batches {
+		if viper.GetBool("VERBOSE") {
+			log.Printf("Applying transaction batch %d of %d (%d operations)", i+1, len(batches), len(batch))
+		}
+		var ok bool
+		var resp *api.TxnResponse
+		attempts := 0
+		err := retry(fmt.Sprintf("Transaction batch %d of %d", i+1, len(batches)), func() error {
+			attempts++
+			var err error
+			if len(batch) == 1 && txnOpSize(batch[0]) > maxTxnBytes {
+				ok, resp, err = applyLargeOp(batch[0], consulClient)
+				return err
+			}
+			ok, resp, _, err = consulClient.Txn().Txn(batch, nil)
+			return err
+		})
+		if err != nil {
+			e := &txnFailedError{batch: i + 1, batches: len(batches), keyRange: batchKeyRange(batch), err: err}
+			for _, unapplied := range batches[i:] {
+				for _, op := range unapplied {
+					e.unapplied = append(e.unapplied, op.KV.Key)
+				}
+			}
+			return e
+		}
+		if !ok && attempts > 1 {
+			ok, err = batchApplied(batch, consulClient)
+			if err != nil {
+				return err
+			}
+			if ok {
+				log.Printf("Transaction batch %d of %d was applied before it was retried", i+1, len(batches))
+			}
+		}
+		if !ok {
+			return newTxnConflictError(i+1, len(batches), batch, resp)
+		}
+	}
+	return nil
+}
+
+// batchApplied reads back the keys of batch and reports whether Consul already
+// holds what the batch writes, as it does when an earlier attempt went through
+// but its response was lost
+func batchApplied(batch api.TxnOps, consulClient *api.Client) (bool, error) {
+	for _, op := range batch {
+		var pairs api.KVPairs
+		err := retry("Reading "+op.KV.Key, func() error {
+			var err error
+			if op.KV.Verb == api.KVDeleteTree {
+				pairs, _, err = consulClient.KV().List(op.KV.Key, nil)
+				return err
+			}
+			var pair *api.KVPair
+			pair, _, err = consulClient.KV().Get(op.KV.Key, nil)
+			pairs = nil
+			if pair != nil {
+				pairs = api.KVPairs{pair}
+			}
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		switch op.KV.Verb {
+		case api.KVSet, api.KVCAS:
+			if len(pairs) == 0 || !bytes.Equal(pairs[0].Value, op.KV.Value) || pairs[0].Flags != op.KV.Flags {
+				return false, nil
+			}
+		case api.KVDelete, api.KVDeleteCAS, api.KVDeleteTree:
+			if len(pairs) != 0 {
+				return false, nil
+			}
+		default:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// applyLargeOp writes an operation too large to fit in a transaction with a
+// plain KV request, keeping its check-and-set index. A failed check-and-set is
+// reported the same way Consul reports one within a transaction.
+func applyLargeOp(op *api.TxnOp, consulClient *api.Client) (bool, *api.TxnResponse, error) {
+	if viper.GetBool("VERBOSE") {
+		log.Printf("Key %s is too large for a transaction; writing it on its own", op.KV.Key)
+	}
+	pair := &api.KVPair{Key: op.KV.Key, Value: op.KV.Value, Flags: op.KV.Flags, ModifyIndex: op.KV.Index}
+	switch op.KV.Verb {
+	case api.KVSet:
+		_, err := consulClient.KV().Put(pair, nil)
+		return err == nil, nil, err
+	case api.KVCAS:
+		ok, _, err := consulClient.KV().CAS(pair, nil)
+		if err != nil || ok {
+			return ok, nil, err
+		}
+		return false, &api.TxnResponse{Errors: api.TxnErrors{{OpIndex: 0, What: fmt.Sprintf("failed to set key %q, index is stale", op.KV.Key)}}}, nil
+	default:
+		return false, nil, fmt.Errorf("operation %s on key %s is too large for a transaction", op.KV.Verb, op.KV.Key)
+	}
+}
+
+// txnFailedError is returned when a batch can't be applied, even after retries.
+// It lists the keys in that batch and the batches after it, none of which were applied.
+type txnFailedError struct {
+	batch     int
+	batches   int
+	keyRange  string
+	err       error
+	unapplied []string
+}
+
+func (e *txnFailedError) Error() string {
+	return fmt.Sprintf("Transaction batch %d of %d failed (%s): %v; %d keys were not applied", e.batch, e.batches, e.keyRange, e.err, len(e.unapplied))
+}
+
+// logSummary logs every key that wasn't applied
+func (e *txnFailedError) logSummary() {
+	log.Printf("%d keys were not applied:", len(e.unapplied))
+	for _, key := range e.unapplied {
+		log.Printf("  %s", key)
+	}
+}
+
+// batchKeyRange describes the keys covered by a batch for error reporting
+func batchKeyRange(batch api.TxnOps) string {
+	first := batch[0].KV.Key
+	last := batch[len(batch)-1].KV.Key
+	if first == last {
+		return "key " + first
+	}
+	return fmt.Sprintf("keys %s through %s", first, last)
+}
+
+// txnConflict is a key Consul refused to change within a transaction
+type txnConflict struct {
+	key    string
+	reason string
+}
+
+// txnConflictError is returned when Consul rolls back a batch, typically
+// because a key changed after it was listed and its check-and-set failed
+type txnConflictError struct {
+	batch     int
+	batches   int
+	keyRange  string
+	conflicts []txnConflict
+}
+
+// newTxnConflictError maps the errors Consul reported for a rolled back batch back to their keys
+func newTxnConflictError(n int, total int, batch api.TxnOps, resp *api.TxnResponse) *txnConflictError {
+	e := &txnConflictError{batch: n, batches: total, keyRange: batchKeyRange(batch)}
+	if resp == nil {
+		return e
+	}
+	for _, te := range resp.Errors {
+		c := txnConflict{reason: te.What}
+		if te.OpIndex >= 0 && te.OpIndex < len(batch) {
+			c.key = batch[te.OpIndex].KV.Key
+		}
+		e.conflicts = append(e.conflicts, c)
+	}
+	return e
+}
+
+func (e *txnConflictError) Error() string {
+	var keys []string
+	for _, c := range e.conflicts {
+		keys = append(keys, c.key)
+	}
+	if len(keys) == 0 {
+		return fmt.Sprintf("Transaction batch %d of %d rolled back (%s)", e.batch, e.batches, e.keyRange)
+	}
+	return fmt.Sprintf("Transaction batch %d of %d rolled back (%s): conflicting keys %s", e.batch, e.batches, e.keyRange, strings.Join(keys, ", "))
+}
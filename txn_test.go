@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestBatchTxnOps(t *testing.T) {
+	setOp := func(key string, size int) *api.TxnOp {
+		return &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: make([]byte, size)}}
+	}
+	manyOps := func(n int, size int) api.TxnOps {
+		var ops api.TxnOps
+		for i := 0; i < n; i++ {
+			ops = append(ops, setOp(fmt.Sprintf("key%03d", i), size))
+		}
+		return ops
+	}
+
+	cases := []struct {
+		name  string
+		ops   api.TxnOps
+		sizes []int
+	}{
+		{"empty", nil, nil},
+		{"single batch", manyOps(3, 1), []int{3}},
+		{"exactly full", manyOps(maxTxnOps, 1), []int{maxTxnOps}},
+		{"op limit", manyOps(maxTxnOps*2+1, 1), []int{maxTxnOps, maxTxnOps, 1}},
+		{"byte limit", manyOps(3, maxTxnBytes/3), []int{2, 1}},
+		{"base64 growth", manyOps(2, 200000), []int{1, 1}},
+		{"largest value", manyOps(2, maxValueSize), []int{1, 1}},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			batches := batchTxnOps(tc.ops)
+			if len(batches) != len(tc.sizes) {
+				t.Fatalf("got %d batches, expected %d", len(batches), len(tc.sizes))
+			}
+			for idx, batch := range batches {
+				if len(batch) != tc.sizes[idx] {
+					t.Errorf("batch %d has %d operations, expected %d", idx, len(batch), tc.sizes[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyTxnOps(t *testing.T) {
+	os.Clearenv()
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, map[string]string{
+		"dir2consul/keep":   "same",
+		"dir2consul/change": "old",
+		"dir2consul/remove": "gone",
+	})
+
+	ops := api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVSet, Key: "dir2consul/change", Value: []byte("new")}},
+		{KV: &api.KVTxnOp{Verb: api.KVSet, Key: "dir2consul/add", Value: []byte("added")}},
+		{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: "dir2consul/remove"}},
+	}
+	err := applyTxnOps(ops, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"dir2consul/keep":   "same",
+		"dir2consul/change": "new",
+		"dir2consul/add":    "added",
+	}
+	actual := fake.values()
+	if len(actual) != len(expect) {
+		t.Errorf("expected %d keys, got %v", len(expect), actual)
+	}
+	for k, v := range expect {
+		if actual[k] != v {
+			t.Errorf("key %s: expected %q, got %q", k, v, actual[k])
+		}
+	}
+	if fake.txns != 1 {
+		t.Errorf("expected a single transaction, got %d", fake.txns)
+	}
+}
+
+func TestApplyTxnOpsLargeValues(t *testing.T) {
+	os.Clearenv()
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, map[string]string{"dir2consul/stale": "old"})
+	near := strings.Repeat("n", maxTxnBytes*3/4-txnOpOverhead-100)
+	largest := strings.Repeat("l", maxValueSize)
+
+	ops := api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: "dir2consul/near", Value: []byte(near)}},
+		{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: "dir2consul/largest", Value: []byte(largest)}},
+		{KV: &api.KVTxnOp{Verb: api.KVSet, Key: "dir2consul/small", Value: []byte("s")}},
+	}
+	for _, op := range ops {
+		body, err := json.Marshal(api.TxnOps{op})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) > txnOpSize(op) {
+			t.Errorf("key %s: request body is %d bytes, budgeted %d", op.KV.Key, len(body), txnOpSize(op))
+		}
+	}
+	err := applyTxnOps(ops, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := fake.values()
+	if actual["dir2consul/near"] != near || actual["dir2consul/largest"] != largest || actual["dir2consul/small"] != "s" {
+		t.Errorf("large values were not written")
+	}
+	if fake.txns != 2 {
+		t.Errorf("expected 2 transactions around the oversized key, got %d", fake.txns)
+	}
+
+	// An oversized write keeps its check-and-set
+	ops = api.TxnOps{{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: "dir2consul/stale", Value: []byte(largest), Index: 999}}}
+	err = applyTxnOps(ops, client)
+	if _, ok := err.(*txnConflictError); !ok || !strings.Contains(err.Error(), "dir2consul/stale") {
+		t.Errorf("expected a conflict on dir2consul/stale, got %v", err)
+	}
+	if fake.values()["dir2consul/stale"] != "old" {
+		t.Errorf("stale key was overwritten")
+	}
+}
+
+func TestApplyTxnOpsLostResponse(t *testing.T) {
+	cases := []struct {
+		name      string
+		edit      bool
+		expectErr bool
+	}{
+		{"applied", false, false},
+		{"edited before the retry", true, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range map[string]string{"D2C_RETRY_ATTEMPTS": "3", "D2C_RETRY_MIN_WAIT": "1ms"} {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setupEnvironment()
+
+			fake, client := newFakeConsul(t, map[string]string{"dir2consul/change": "old", "dir2consul/remove": "gone"})
+			// The first attempt goes through but its response is lost, so the retry conflicts
+			fake.loseTxn = func(n int) bool { return n == 1 }
+			if tc.edit {
+				fake.beforeTxn = func() {
+					if fake.txns == 1 {
+						fake.set("dir2consul/change", "edited")
+					}
+				}
+			}
+			_, consulPairs, err := loadKeyValuesFromConsul(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := api.TxnOps{
+				{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: "dir2consul/change", Value: []byte("new"), Index: consulPairs["dir2consul/change"].ModifyIndex}},
+				{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: "dir2consul/add", Value: []byte("added")}},
+				{KV: &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: "dir2consul/remove", Index: consulPairs["dir2consul/remove"].ModifyIndex}},
+			}
+			err = applyTxnOps(ops, client)
+			if fake.txns != 2 {
+				t.Errorf("expected the batch to be retried once, got %d transactions", fake.txns)
+			}
+			if !tc.expectErr {
+				if err != nil {
+					t.Fatalf("expected the applied batch to count as applied, got %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*txnConflictError); !ok {
+				t.Errorf("expected a txnConflictError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyTxnOpsRetries(t *testing.T) {
+	cases := []struct {
+		name       string
+		failFrom   int
+		failUntil  int
+		expectErr  bool
+		expectKeys int
+		expectTxns int
+	}{
+		{"transient failure recovers", 2, 2, false, maxTxnOps * 3, 4},
+		{"persistent failure stops", 2, 100, true, maxTxnOps, 4},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			err := os.Setenv("D2C_RETRY_ATTEMPTS", "3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Setenv("D2C_RETRY_MIN_WAIT", "1ms")
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupEnvironment()
+
+			fake, client := newFakeConsul(t, nil)
+			fake.failTxn = func(n int) string {
+				if n >= tc.failFrom && n <= tc.failUntil {
+					return "No cluster leader"
+				}
+				return ""
+			}
+
+			var ops api.TxnOps
+			for i := 0; i < maxTxnOps*3; i++ {
+				ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: fmt.Sprintf("dir2consul/key%03d", i), Value: []byte("v")}})
+			}
+			err = applyTxnOps(ops, client)
+			if !tc.expectErr && err != nil {
+				t.Fatal(err)
+			}
+			if tc.expectErr {
+				failed, ok := err.(*txnFailedError)
+				if !ok {
+					t.Fatalf("expected a txnFailedError, got %v", err)
+				}
+				if !strings.Contains(err.Error(), "batch 2 of 3") || !strings.Contains(err.Error(), "dir2consul/key064") {
+					t.Errorf("error does not identify the failed batch: %s", err)
+				}
+				if len(failed.unapplied) != maxTxnOps*2 {
+					t.Errorf("expected %d unapplied keys, got %d", maxTxnOps*2, len(failed.unapplied))
+				}
+			}
+			if len(fake.values()) != tc.expectKeys {
+				t.Errorf("expected %d keys applied, got %d", tc.expectKeys, len(fake.values()))
+			}
+			if fake.txns != tc.expectTxns {
+				t.Errorf("expected %d transactions, got %d", tc.expectTxns, fake.txns)
+			}
+		})
+	}
+}
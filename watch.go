@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/code42/dir2consul/kv"
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+// keyScope is a set of Consul key prefixes. A key is in scope when it equals
+// one of the prefixes or is below one.
+type keyScope []string
+
+// contains is true when key is in the scope
+func (s keyScope) contains(key string) bool {
+	for _, prefix := range s {
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// changeScope returns the keys a change to rel, a path relative to DIRECTORY,
+// can affect: the keys loaded from a file, or every key below a directory or
+// a default file, since defaults apply to every file beside and below them.
+// A .env file or a rollup marker covers its directory the same way.
+func changeScope(rel string) keyScope {
+	prefix := viper.GetString("CONSUL_KEY_PREFIX")
+	rel = filepath.Clean(rel)
+	base := filepath.Base(rel)
+	if base == "default" || base == "default"+filepath.Ext(base) || base == ".env" || base == viper.GetString("ROLLUP_MARKER") {
+		rel = filepath.Dir(rel)
+	}
+	if rel == "." {
+		return keyScope{prefix}
+	}
+
+	// A removed path can't be told apart from a directory, so cover both readings
+	scope := keyScope{prefix + "/" + filepath.ToSlash(rel)}
+	if elemKey := strings.TrimSuffix(rel, filepath.Ext(rel)); elemKey != rel {
+		scope = append(scope, prefix+"/"+filepath.ToSlash(elemKey))
+	}
+	return scope
+}
+
+// runWatch syncs, then keeps syncing the files that change until interrupted
+func runWatch(consulClient *api.Client) error {
+	err := setupMetrics()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, stopping", sig)
+		close(stop)
+	}()
+	return watch(consulClient, stop)
+}
+
+// watch syncs everything, then watches DIRECTORY for changes. Changes are
+// collected until none arrive for WATCH_DEBOUNCE, and then only the keys the
+// changed files affect are synced. When DIRECTORY is a symlink, as with
+// git-sync, replacing the link resyncs everything. Failed syncs are logged
+// and retried after RETRY_MAX_WAIT.
+//
+// With WATCH_CONSUL set, changes under CONSUL_KEY_PREFIX are watched as well
+// and everything is synced again, at most once every REVERT_INTERVAL, which
+// reverts edits made in Consul to keys managed by dir2consul.
+func watch(consulClient *api.Client, stop <-chan struct{}) error {
+	dirIgnoreRe, fileIgnoreRe, err := compileRegexps(viper.GetString("IGNORE_DIR_REGEX"), viper.GetString("IGNORE_FILE_REGEX"))
+	if err != nil {
+		return err
+	}
+	link, err := filepath.Abs(viper.GetString("DIRECTORY"))
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Close() }()
+
+	// Watch the link's directory to see the link being replaced
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		err = watcher.Add(filepath.Dir(link))
+		if err != nil {
+			return err
+		}
+	}
+
+	var root string
+	watched := make(map[string]bool)
+	rewatch := func() error {
+		for dir := range watched {
+			_ = watcher.Remove(dir)
+			delete(watched, dir)
+		}
+		root, err = filepath.EvalSymlinks(link)
+		if err != nil {
+			return err
+		}
+		return watchTree(watcher, watched, root, root, dirIgnoreRe)
+	}
+	err = rewatch()
+	if err != nil {
+		return err
+	}
+
+	syncScope := func(scope keyScope) (*plan, error) {
+		fileKeyValues := kv.NewList()
+		report, err := loadKeyValuesFromDisk(fileKeyValues, dirIgnoreRe, fileIgnoreRe)
+		if err != nil {
+			return nil, err
+		}
+		err = report.check(viper.GetBool("STRICT"))
+		if err != nil {
+			return nil, err
+		}
+		scope = report.widen(scope)
+		var p *plan
+		err = withLock(consulClient, func() error {
+			var err error
+			p, err = syncConsul(fileKeyValues, scope, consulClient)
+			return err
+		})
+		return p, err
+	}
+
+	prefix := viper.GetString("CONSUL_KEY_PREFIX")
+	consulChanged := make(chan struct{}, 1)
+	if viper.GetBool("WATCH_CONSUL") {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watchConsul(ctx, consulClient, consulChanged)
+		log.Printf("Watching Consul prefix %s", prefix)
+	}
+
+	// pending covers the keys of files that changed since the last sync, and
+	// reconcile is set when Consul changed and every key should be synced
+	pending := keyScope{prefix}
+	reconcile := false
+	var lastReconcile time.Time
+	debounce := viper.GetDuration("WATCH_DEBOUNCE")
+	fire := time.After(0)
+	log.Printf("Watching %s", link)
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Error watching %s: %s", link, err)
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			switch {
+			case event.Name == link:
+				if err := rewatch(); err != nil {
+					log.Printf("Error watching %s: %s", link, err)
+				}
+				pending = append(pending, prefix)
+			case strings.HasPrefix(event.Name, root+string(filepath.Separator)):
+				rel, _ := filepath.Rel(root, event.Name)
+				if base := filepath.Base(rel); strings.HasPrefix(base, ".") && base != ".env" && base != viper.GetString("ROLLUP_MARKER") {
+					continue
+				}
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						if err := watchTree(watcher, watched, root, event.Name, dirIgnoreRe); err != nil {
+							log.Printf("Error watching %s: %s", event.Name, err)
+						}
+					}
+				}
+				if viper.GetBool("VERBOSE") {
+					log.Printf("Changed: %s", event)
+				}
+				pending = append(pending, changeScope(rel)...)
+			default:
+				continue
+			}
+			fire = time.After(debounce)
+
+		case <-consulChanged:
+			reconcile = true
+			if fire == nil {
+				fire = time.After(0)
+			}
+
+		case <-fire:
+			if wait := time.Until(lastReconcile.Add(viper.GetDuration("REVERT_INTERVAL"))); reconcile && wait > 0 {
+				fire = time.After(wait)
+				continue
+			}
+			fire = nil
+			fileScope, scope := pending, pending
+			pending = nil
+			if reconcile {
+				scope = keyScope{prefix}
+				lastReconcile = time.Now()
+			}
+			if viper.GetBool("VERBOSE") {
+				sort.Strings(scope)
+				log.Printf("Syncing keys under %s", strings.Join(scope, ", "))
+			}
+			p, err := syncScope(scope)
+			if err != nil {
+				log.Printf("Error syncing %s, retrying in %s: %s", link, viper.GetDuration("RETRY_MAX_WAIT"), err)
+				pending = append(pending, fileScope...)
+				fire = time.After(viper.GetDuration("RETRY_MAX_WAIT"))
+				continue
+			}
+			if reconcile {
+				logReverts(p, fileScope)
+				reconcile = false
+			}
+		}
+	}
+}
+
+// watchTree adds dir and the directories below it to watcher, skipping the
+// hidden and ignored directories loadKeyValuesFromDisk skips
+func watchTree(watcher *fsnotify.Watcher, watched map[string]bool, root string, dir string, dirIgnoreRe *regexp.Regexp) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root {
+			rel, _ := filepath.Rel(root, path)
+			if strings.HasPrefix(info.Name(), ".") || dirIgnoreRe.MatchString(rel) {
+				return filepath.SkipDir
+			}
+		}
+		err = watcher.Add(path)
+		if err != nil {
+			return err
+		}
+		watched[path] = true
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangeScope(t *testing.T) {
+	os.Clearenv()
+	setupEnvironment()
+
+	cases := []struct {
+		rel    string
+		expect keyScope
+	}{
+		{"app.yaml", keyScope{"dir2consul/app.yaml", "dir2consul/app"}},
+		{"app/db.properties", keyScope{"dir2consul/app/db.properties", "dir2consul/app/db"}},
+		{"app", keyScope{"dir2consul/app"}},
+		{"app/default.yaml", keyScope{"dir2consul/app"}},
+		{"app/default", keyScope{"dir2consul/app"}},
+		{"default.yaml", keyScope{"dir2consul"}},
+		{"flags/.dir2consul-rollup", keyScope{"dir2consul/flags"}},
+		{"app/.env", keyScope{"dir2consul/app"}},
+		{"app/db.env", keyScope{"dir2consul/app/db.env", "dir2consul/app/db"}},
+		{".", keyScope{"dir2consul"}},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.rel), func(t *testing.T) {
+			actual := changeScope(tc.rel)
+			if !reflect.DeepEqual(actual, tc.expect) {
+				t.Errorf("expected %v, got %v", tc.expect, actual)
+			}
+		})
+	}
+}
+
+func TestKeyScopeContains(t *testing.T) {
+	scope := keyScope{"dir2consul/app"}
+	for key, expect := range map[string]bool{
+		"dir2consul/app":      true,
+		"dir2consul/app/port": true,
+		"dir2consul/apple":    false,
+		"dir2consul/web/port": false,
+	} {
+		if scope.contains(key) != expect {
+			t.Errorf("contains(%s) should be %v", key, expect)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	writeFile := func(name string, content string) {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("app/config.properties", "port=8080\n")
+	writeFile("web/config.properties", "port=80\n")
+
+	os.Clearenv()
+	err = os.Setenv("D2C_DIRECTORY", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_WATCH_DEBOUNCE", "50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, nil)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- watch(client, stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The first sync covers everything
+	waitForValue(t, fake, "dir2consul/app/config/port", "8080")
+	waitForValue(t, fake, "dir2consul/web/config/port", "80")
+
+	// A change to one file syncs its keys and leaves the rest alone
+	fake.set("dir2consul/web/config/port", "8000")
+	writeFile("app/config.properties", "port=9090\n")
+	waitForValue(t, fake, "dir2consul/app/config/port", "9090")
+	if fake.values()["dir2consul/web/config/port"] != "8000" {
+		t.Errorf("a key outside the change was synced: %v", fake.values())
+	}
+
+	// A default file affects every key beside and below it
+	writeFile("default.properties", "region=us\n")
+	waitForValue(t, fake, "dir2consul/app/config/region", "us")
+	waitForValue(t, fake, "dir2consul/web/config/region", "us")
+	waitForValue(t, fake, "dir2consul/web/config/port", "80")
+
+	// New directories are watched too
+	writeFile("api/config.properties", "port=7070\n")
+	waitForValue(t, fake, "dir2consul/api/config/port", "7070")
+}
+
+func TestWatchSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for rev, port := range map[string]string{"rev1": "8080", "rev2": "9090"} {
+		err = os.MkdirAll(filepath.Join(dir, rev, "app"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, rev, "app", "config.properties"), []byte("port="+port+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "repo")
+	err = os.Symlink(filepath.Join(dir, "rev1"), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Clearenv()
+	err = os.Setenv("D2C_DIRECTORY", link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("D2C_WATCH_DEBOUNCE", "50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupEnvironment()
+
+	fake, client := newFakeConsul(t, nil)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- watch(client, stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	waitForValue(t, fake, "dir2consul/app/config/port", "8080")
+
+	// Replace the link atomically, the way git-sync does
+	err = os.Symlink(filepath.Join(dir, "rev2"), link+".tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(link+".tmp", link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, fake, "dir2consul/app/config/port", "9090")
+}
+
+// waitForValue waits up to five seconds for the fake to hold value at key
+func waitForValue(t *testing.T, fake *fakeConsul, key string, value string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.values()[key] != value {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s=%s, have %v", key, value, fake.values())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}